@@ -0,0 +1,324 @@
+package wu2quant
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+)
+
+// CountColors returns the number of unique colours in m, counting each 24-bit
+// RGB value once and ignoring alpha, as the quantizer does. If limit is greater
+// than zero, counting stops as soon as limit colours have been found.
+//
+// If m is not an *image.RGBA, it will be converted to one first.
+// Depending on the image type, this may trigger very slow code paths.
+func CountColors(m image.Image, limit int) int {
+	var (
+		img    = convertToRGBA(m)
+		bounds = img.Bounds()
+		seen   = make([]uint64, (1<<24)/64)
+		count  int
+	)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		idx := img.PixOffset(bounds.Min.X, y)
+		end := idx + bounds.Dx()*4
+		for ; idx < end; idx += 4 {
+			c := uint32(img.Pix[idx])<<16 | uint32(img.Pix[idx+1])<<8 | uint32(img.Pix[idx+2])
+			bit := uint64(1) << (c & 63)
+			if seen[c>>6]&bit == 0 {
+				seen[c>>6] |= bit
+				count++
+				if count == limit {
+					return count
+				}
+			}
+		}
+	}
+
+	return count
+}
+
+// ColorCount is a colour and the number of pixels of that colour in an image.
+type ColorCount struct {
+	Color color.RGBA
+	Count int
+}
+
+// TopColors returns the n most frequent colours in m, most frequent first. Ties
+// are ordered by colour. If n <= 0, every colour in m is returned. Colours are
+// compared as 24-bit RGB values, ignoring alpha, and are returned as opaque.
+//
+// If m is not an *image.RGBA, it will be converted to one first.
+// Depending on the image type, this may trigger very slow code paths.
+func TopColors(m image.Image, n int) []ColorCount {
+	var (
+		img    = convertToRGBA(m)
+		bounds = img.Bounds()
+		counts = make(map[uint32]int)
+	)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		idx := img.PixOffset(bounds.Min.X, y)
+		end := idx + bounds.Dx()*4
+		for ; idx < end; idx += 4 {
+			counts[uint32(img.Pix[idx])<<16|uint32(img.Pix[idx+1])<<8|uint32(img.Pix[idx+2])]++
+		}
+	}
+
+	top := make([]ColorCount, 0, len(counts))
+	for c, count := range counts {
+		top = append(top, ColorCount{
+			Color: color.RGBA{R: uint8(c >> 16), G: uint8(c >> 8), B: uint8(c), A: 0xff},
+			Count: count,
+		})
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		a, b := top[i].Color, top[j].Color
+		return uint32(a.R)<<16|uint32(a.G)<<8|uint32(a.B) < uint32(b.R)<<16|uint32(b.G)<<8|uint32(b.B)
+	})
+
+	if n > 0 && n < len(top) {
+		top = top[:n]
+	}
+	return top
+}
+
+// HistogramCells is the number of cells along each axis of a Histogram.
+const HistogramCells = 32
+
+// Histogram is the colour histogram Wu's algorithm is built on. Each channel is
+// divided into HistogramCells cells of 8 values, and each cell records the
+// number of pixels and the sum of the colours that fall into it.
+//
+// Histograms of separate sets of images can be combined with Merge, and stored
+// or sent elsewhere with MarshalBinary, so that a palette for all of the images
+// can be built by Quantizer.HistogramPalette without visiting them again.
+type Histogram struct {
+	// wt, mr, mg and mb hold the count and sums of each cell, as they do in
+	// histogram3D. The sums of squares are kept for each channel in sq instead
+	// of being combined, so that any channel weights can be applied when the
+	// palette is built.
+	mr, mg, mb moment
+	wt         moment
+	sq         *[3]momentFloat64
+	pixels     int64
+}
+
+// HistogramCell describes the pixels in one cell of a Histogram.
+type HistogramCell struct {
+	// Count is the number of pixels in the cell.
+	Count int64
+
+	// Mean is the mean colour of the pixels in the cell, or the zero value if
+	// the cell is empty.
+	Mean color.RGBA
+}
+
+// NewHistogram returns an empty Histogram. The zero value is also an empty
+// Histogram, ready to use.
+func NewHistogram() *Histogram {
+	return &Histogram{}
+}
+
+// Add accumulates the pixels of m into the histogram.
+//
+// If m is not an *image.RGBA, it will be converted to one first.
+// Depending on the image type, this may trigger very slow code paths.
+func (h *Histogram) Add(m image.Image) {
+	img := convertToRGBA(m)
+	if h.sq == nil {
+		h.sq = new([3]momentFloat64)
+	}
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		pix := img.Pix[img.PixOffset(bounds.Min.X, y):][:bounds.Dx()*4]
+		for idx := 0; idx < len(pix); idx += 4 {
+			r, g, b := int64(pix[idx]), int64(pix[idx+1]), int64(pix[idx+2])
+			inr, ing, inb := (r>>3)+1, (g>>3)+1, (b>>3)+1
+
+			h.wt[inr][ing][inb]++
+			h.mr[inr][ing][inb] += r
+			h.mg[inr][ing][inb] += g
+			h.mb[inr][ing][inb] += b
+			h.sq[0][inr][ing][inb] += float64(r * r)
+			h.sq[1][inr][ing][inb] += float64(g * g)
+			h.sq[2][inr][ing][inb] += float64(b * b)
+		}
+	}
+	h.pixels += int64(bounds.Dx() * bounds.Dy())
+}
+
+// Pixels returns the total number of pixels added to the histogram.
+func (h *Histogram) Pixels() int64 {
+	return h.pixels
+}
+
+// Cell returns the cell at the given cell coordinates, which must be between 0
+// and HistogramCells-1. Cell panics if any coordinate is out of range. The cell
+// containing a colour c is at c.R>>3, c.G>>3, c.B>>3.
+func (h *Histogram) Cell(r, g, b int) HistogramCell {
+	if uint(r) >= HistogramCells || uint(g) >= HistogramCells || uint(b) >= HistogramCells {
+		// Index 0 of each axis is padding, so -1 would not panic by itself:
+		panic(fmt.Sprintf("wu2quant: histogram cell %d, %d, %d out of range", r, g, b))
+	}
+	r, g, b = r+1, g+1, b+1
+
+	cell := HistogramCell{Count: h.wt[r][g][b]}
+	if cell.Count > 0 {
+		cell.Mean = color.RGBA{
+			R: uint8(h.mr[r][g][b] / cell.Count),
+			G: uint8(h.mg[r][g][b] / cell.Count),
+			B: uint8(h.mb[r][g][b] / cell.Count),
+			A: 0xff,
+		}
+	}
+	return cell
+}
+
+// Occupied returns the number of cells that contain at least one pixel.
+func (h *Histogram) Occupied() int {
+	var n int
+	for r := 1; r <= HistogramCells; r++ {
+		for g := 1; g <= HistogramCells; g++ {
+			for b := 1; b <= HistogramCells; b++ {
+				if h.wt[r][g][b] != 0 {
+					n++
+				}
+			}
+		}
+	}
+	return n
+}
+
+// colorSet is a small open addressing hash table mapping exact 24-bit colours to
+// palette indices, used to avoid quantizing images that already have few enough
+// colours to fit in the palette.
+//
+// Each entry packs an occupied flag, the palette index and the colour:
+//
+//	1 bit flag | 15 bits unused | 16 bits index | 8 bits unused | 24 bits colour
+type colorSet struct {
+	entries [colorSetSize]uint64
+	colors  [maxColors]uint32
+	len     int
+}
+
+const (
+	colorSetSize     = 2 * int(maxColors)
+	colorSetMask     = colorSetSize - 1
+	colorSetOccupied = 1 << 63
+)
+
+func (cs *colorSet) clear() {
+	if cs.len > 0 {
+		cs.entries = [colorSetSize]uint64{}
+		cs.len = 0
+	}
+}
+
+func colorSetHash(c uint32) int {
+	return int((c * 0x9e3779b1) >> 16)
+}
+
+// insert adds c to the set if it isn't already present and returns its index. If
+// adding c would take the set past limit colours, insert returns false.
+func (cs *colorSet) insert(c uint32, limit int) (idx paletteIndex, ok bool) {
+	for i := colorSetHash(c); ; i++ {
+		e := cs.entries[i&colorSetMask]
+		if e == 0 {
+			if cs.len >= limit {
+				return 0, false
+			}
+			idx = paletteIndex(cs.len)
+			cs.entries[i&colorSetMask] = colorSetOccupied | uint64(idx)<<32 | uint64(c)
+			cs.colors[idx] = c
+			cs.len++
+			return idx, true
+		}
+		if uint32(e)&0xffffff == c {
+			return paletteIndex(e >> 32), true
+		}
+	}
+}
+
+// index returns the index of c, which must be in the set.
+func (cs *colorSet) index(c uint32) paletteIndex {
+	for i := colorSetHash(c); ; i++ {
+		e := cs.entries[i&colorSetMask]
+		if uint32(e)&0xffffff == c && e != 0 {
+			return paletteIndex(e >> 32)
+		}
+	}
+}
+
+// exactColors collects the unique colours in img into q.exact, and returns true
+// if there are no more than paletteColors of them. into is filled with the
+// colours in the order they first appear in img.
+func (q *Quantizer) exactColors(into *quantizedColors, img *image.RGBA, paletteColors int) bool {
+	q.exact.clear()
+
+	var (
+		bounds = img.Bounds()
+		last   uint32
+		first  = true
+	)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		idx := img.PixOffset(bounds.Min.X, y)
+		end := idx + bounds.Dx()*4
+		for ; idx < end; idx += 4 {
+			c := uint32(img.Pix[idx])<<16 | uint32(img.Pix[idx+1])<<8 | uint32(img.Pix[idx+2])
+			if c == last && !first {
+				continue
+			}
+			if _, ok := q.exact.insert(c, paletteColors); !ok {
+				return false
+			}
+			last, first = c, false
+		}
+	}
+
+	for i := 0; i < q.exact.len; i++ {
+		c := q.exact.colors[i]
+		into.rLut[i], into.gLut[i], into.bLut[i] = uint8(c>>16), uint8(c>>8), uint8(c)
+	}
+	into.paletteSize = paletteIndex(q.exact.len)
+	into.mapping = mapExact
+
+	return true
+}
+
+// mapExact writes the index of each pixel of m in q.exact to the pixel with the
+// same coordinates in o. Pixels excluded by mask, which may be nil, are not
+// written.
+func (q *Quantizer) mapExact(o *image.Paletted, m *image.RGBA, mask *image.Alpha) {
+	var (
+		bounds = m.Bounds()
+		last   uint32
+		lastID paletteIndex
+		first  = true
+	)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		src := m.PixOffset(bounds.Min.X, y)
+		dst := o.PixOffset(bounds.Min.X, y)
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := uint32(m.Pix[src])<<16 | uint32(m.Pix[src+1])<<8 | uint32(m.Pix[src+2])
+			if c != last || first {
+				last, lastID, first = c, q.exact.index(c), false
+			}
+			if !maskedOut(mask, x, y) {
+				o.Pix[dst] = uint8(lastID)
+			}
+			src += 4
+			dst++
+		}
+	}
+}
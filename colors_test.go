@@ -0,0 +1,89 @@
+package wu2quant
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestCountColors(t *testing.T) {
+	pal := genRandomRGBAPalette(rand.New(rand.NewSource(0)), 10)
+	img := genRings(pal, 20)
+
+	if n := CountColors(img, 0); n != 10 {
+		t.Fatal(n)
+	}
+	if n := CountColors(img, 4); n != 4 {
+		t.Fatal(n)
+	}
+	if n := CountColors(img.SubImage(image.Rect(5, 5, 15, 15)), 0); n != 5 {
+		t.Fatal(n)
+	}
+
+	img = genRGBAWithUniqueRGBPerPixel(64, 64)
+	if n := CountColors(img, 0); n != 64*64 {
+		t.Fatal(n)
+	}
+}
+
+func TestTopColors(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 1))
+	img.SetRGBA(0, 0, color.RGBA{3, 3, 3, 0xff})
+	img.SetRGBA(1, 0, color.RGBA{1, 1, 1, 0xff})
+	img.SetRGBA(2, 0, color.RGBA{3, 3, 3, 0xff})
+	img.SetRGBA(3, 0, color.RGBA{2, 2, 2, 0xff})
+
+	exp := []ColorCount{
+		{color.RGBA{3, 3, 3, 0xff}, 2},
+		{color.RGBA{1, 1, 1, 0xff}, 1},
+	}
+	if top := TopColors(img, 2); !reflect.DeepEqual(exp, top) {
+		t.Fatal(top)
+	}
+	if top := TopColors(img, 0); len(top) != 3 {
+		t.Fatal(top)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 1))
+	img.SetRGBA(0, 0, color.RGBA{0x10, 0x20, 0x30, 0xff})
+	img.SetRGBA(1, 0, color.RGBA{0x12, 0x22, 0x32, 0xff})
+	img.SetRGBA(2, 0, color.RGBA{0xf0, 0xf0, 0xf0, 0xff})
+
+	h := NewHistogram()
+	h.Add(img)
+	h.Add(img.SubImage(image.Rect(2, 0, 3, 1)))
+
+	if h.Pixels() != 4 {
+		t.Fatal(h.Pixels())
+	}
+	if h.Occupied() != 2 {
+		t.Fatal(h.Occupied())
+	}
+
+	cell := h.Cell(0x10>>3, 0x20>>3, 0x30>>3)
+	if cell != (HistogramCell{Count: 2, Mean: color.RGBA{0x11, 0x21, 0x31, 0xff}}) {
+		t.Fatal(cell)
+	}
+	cell = h.Cell(0xf0>>3, 0xf0>>3, 0xf0>>3)
+	if cell != (HistogramCell{Count: 2, Mean: color.RGBA{0xf0, 0xf0, 0xf0, 0xff}}) {
+		t.Fatal(cell)
+	}
+	if cell := h.Cell(0, 0, 0); cell != (HistogramCell{}) {
+		t.Fatal(cell)
+	}
+
+	for _, c := range [][3]int{{-1, 0, 0}, {0, HistogramCells, 0}, {0, 0, -1}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal(c)
+				}
+			}()
+			h.Cell(c[0], c[1], c[2])
+		}()
+	}
+}
@@ -0,0 +1,194 @@
+package wu2quant
+
+import (
+	"fmt"
+	"image"
+)
+
+// Config controls how a Quantizer builds palettes and maps images to them. The
+// zero value is Wu's original algorithm, mapping each pixel to a palette of the
+// requested size without dithering.
+type Config struct {
+	// Colors is the palette size used by ToPaletted, IntoPaletted, RGBAToIndices
+	// and their variants when they are passed 0. Only RGBAToIndices16 supports
+	// more than 256 colours, up to 4096. Defaults to 256.
+	Colors int
+
+	// Generator selects how the palette is chosen. Defaults to GeneratorWu. The
+	// other generators produce fixed palettes, so the settings that control how
+	// the palette is built from the image, such as Split, Exact, Sample, Depth
+	// and PaletteMask, do not apply to them. Generators apply to Quantize,
+	// ToPaletted, IntoPaletted, RGBAToIndices, Mapper and their variants.
+	// Sequence, Stream, ToGIF, ToTiled, HistogramPalette and HistogramMapper
+	// always use Wu's algorithm, and return an error for any other generator.
+	Generator PaletteGenerator
+
+	// Levels is the number of levels per channel used by GeneratorLevels.
+	Levels Levels
+
+	// Split selects how the colour space is divided into palette entries.
+	// Defaults to SplitVariance, Wu's original strategy.
+	Split SplitStrategy
+
+	// Weights scales each channel's contribution to the distance between
+	// colours. Defaults to equal weights for all channels.
+	Weights ChannelWeights
+
+	// ColorSpace selects the space in which colours are averaged. Defaults to
+	// ColorSpaceSRGB.
+	ColorSpace ColorSpace
+
+	// Mapping selects how pixels are matched to palette entries. Defaults to
+	// MapBox.
+	Mapping MapMode
+
+	// Dither applies Floyd-Steinberg error diffusion when mapping pixels to the
+	// palette in ToPaletted, IntoPaletted, RGBAToIndices and their variants.
+	// Dither has no effect if Exact applies, may not be combined with MapMask,
+	// and supports palettes of up to 256 colours.
+	Dither bool
+
+	// Transparent reserves the last palette entry for pixels with an alpha value
+	// below 50%, which are excluded from the histogram and mapped to a fully
+	// transparent colour. The entry is only reserved if the image has such
+	// pixels. Exact is ignored if the entry is reserved.
+	Transparent bool
+
+	// Exact skips quantization if the image contains no more unique colours than
+	// the requested palette size, producing a palette of exactly those colours
+	// instead. Wu's algorithm merges similar colours even when there is room in
+	// the palette for all of them, so this avoids altering images like icons,
+	// pixel art and charts that are already within the limit.
+	//
+	// Exact is opt-in, rather than detected automatically, so that existing
+	// callers keep getting the same palettes for the same images. Colours are
+	// compared by their R, G and B channels only, so pixels that differ only in
+	// alpha share an entry, and the palette is opaque. Exact only applies to
+	// palettes of up to 256 colours, and is ignored if Depth, PaletteMask or a
+	// Generator other than GeneratorWu is set.
+	Exact bool
+
+	// Sample selects the pixels used to build the palette. Every pixel is still
+	// mapped to the palette. Defaults to using every pixel.
+	Sample Sampling
+
+	// Precise accumulates the sums of squares used to measure the variance of
+	// each box in float64 rather than float32. On images of more than a few
+	// megapixels, the float32 sums lose enough precision to change which boxes
+	// are split; Precise keeps them exact at the cost of more memory and a
+	// slightly slower histogram.
+	Precise bool
+
+	// Depth restricts the palette to colours a display with fewer bits per
+	// channel can show. Each palette entry is snapped to the nearest
+	// representable colour, and pixels are mapped to the nearest snapped entry.
+	// Exact is ignored if Depth is set. Defaults to 8 bits per channel.
+	Depth Depth
+
+	// PaletteMask limits the pixels used to build the palette to those where the
+	// alpha of the mask is not zero, such as a cutout of the subject of an image.
+	// Every pixel is still mapped to the palette. The mask is aligned with the
+	// image, and pixels outside its bounds are masked out. Exact is ignored if
+	// PaletteMask is set.
+	PaletteMask image.Image
+
+	// MapMask limits the pixels written by IntoPaletted and RGBAIntoPaletted to
+	// those where the alpha of the mask is not zero; the rest of the output image
+	// is left unchanged. ToPaletted and RGBAToPaletted leave masked out pixels
+	// at index 0. The mask is aligned with the image, and pixels outside its
+	// bounds are masked out.
+	MapMask image.Image
+
+	// Parallelism is the number of goroutines used to build the histogram of a
+	// large image and map it to the palette. Each goroutine after the first
+	// needs its own 1.3MB histogram. Unless Precise is set, the palette may
+	// differ very slightly from the one built by a single goroutine, as the
+	// float32 sums are added in a different order. Defaults to 1.
+	Parallelism int
+}
+
+// ColorSpace selects the space in which colours are averaged.
+type ColorSpace int
+
+const (
+	// ColorSpaceSRGB averages the sRGB encoded values stored in the image, as
+	// Wu's algorithm does.
+	ColorSpaceSRGB ColorSpace = iota
+
+	// ColorSpaceLinear averages colours in linear light. Averaging sRGB values
+	// makes palette entries that cover a range of colours too dark; in linear
+	// light, the averages are calculated then encoded back to sRGB.
+	ColorSpaceLinear
+)
+
+// MapMode selects how pixels are matched to palette entries.
+type MapMode int
+
+const (
+	// MapBox maps each pixel to the entry for the box of the colour space that
+	// contains it. This is what Wu's algorithm does, and is the fastest, but a
+	// colour near the edge of a box may be nearer to another box's entry.
+	MapBox MapMode = iota
+
+	// MapNearest maps the pixels in each cell of the histogram to the entry
+	// nearest to the mean of their colours. It costs a search of the palette
+	// for each occupied cell.
+	MapNearest
+)
+
+// validate checks c for settings that are out of range or that can't be used
+// together.
+func (c Config) validate() error {
+	if c.Colors != 0 {
+		if err := checkPaletteColors(c.Colors, maxWideColors); err != nil {
+			return err
+		}
+	}
+	if c.Split < SplitVariance || c.Split > SplitVolume {
+		return fmt.Errorf("unknown split strategy %d", c.Split)
+	}
+	if w := c.Weights; w.R < 0 || w.G < 0 || w.B < 0 {
+		return fmt.Errorf("channel weights must not be negative; found %+v", w)
+	}
+	if c.ColorSpace != ColorSpaceSRGB && c.ColorSpace != ColorSpaceLinear {
+		return fmt.Errorf("unknown color space %d", c.ColorSpace)
+	}
+	if c.Generator < GeneratorWu || c.Generator > GeneratorLevels {
+		return fmt.Errorf("unknown palette generator %d", c.Generator)
+	}
+	if c.Generator == GeneratorLevels {
+		if err := c.Levels.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Mapping != MapBox && c.Mapping != MapNearest {
+		return fmt.Errorf("unknown mapping mode %d", c.Mapping)
+	}
+	if c.Dither && c.MapMask != nil {
+		return fmt.Errorf("dithering can not be combined with a map mask")
+	}
+	if c.Dither && c.Colors > int(maxColors) {
+		return fmt.Errorf("dithering supports palettes of up to %d colours; found %d", maxColors, c.Colors)
+	}
+	if c.Parallelism < 0 {
+		return fmt.Errorf("parallelism must not be negative; found %d", c.Parallelism)
+	}
+	if err := c.Sample.validate(); err != nil {
+		return err
+	}
+	if err := c.Depth.validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// paletteColors returns paletteColors, or the default palette size if it is 0.
+func (c *Config) paletteColors(paletteColors int) int {
+	if paletteColors != 0 {
+		return paletteColors
+	}
+	if c.Colors != 0 {
+		return c.Colors
+	}
+	return int(maxColors)
+}
@@ -0,0 +1,204 @@
+package wu2quant
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestNewWithConfigInvalid(t *testing.T) {
+	for i, c := range []Config{
+		{Colors: -1},
+		{Colors: 4097},
+		{Colors: 257, Dither: true},
+		{Split: SplitVolume + 1},
+		{Weights: ChannelWeights{R: -1}},
+		{ColorSpace: ColorSpaceLinear + 1},
+		{Mapping: MapNearest + 1},
+		{Dither: true, MapMask: image.NewAlpha(image.Rect(0, 0, 1, 1))},
+		{Parallelism: -1},
+		{Sample: Sampling{Mode: SampleEvery}},
+		{Depth: Depth{R: 9, G: 8, B: 8}},
+	} {
+		if _, err := NewWithConfig(c); err == nil {
+			t.Fatal(i, c)
+		}
+	}
+
+	q, err := NewWithConfig(Config{Colors: 16, Dither: true, Parallelism: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Colors != 16 {
+		t.Fatal(q.Colors)
+	}
+}
+
+func TestConfigColors(t *testing.T) {
+	img := genRGBAWithRandomRGBPerPixel(rand.New(rand.NewSource(0)), 64, 64)
+
+	for _, tc := range []struct {
+		colors, arg, exp int
+	}{
+		{0, 0, 256},
+		{16, 0, 16},
+		{16, 4, 4},
+	} {
+		q := New()
+		q.Colors = tc.colors
+		result, err := q.ToPaletted(tc.arg, img, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Palette) != tc.exp {
+			t.Fatal(tc, len(result.Palette))
+		}
+	}
+}
+
+func TestConfigMapNearest(t *testing.T) {
+	img := genRGBAWithRandomRGBPerPixel(rand.New(rand.NewSource(0)), 100, 100)
+
+	box, err := New().ToPaletted(16, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := New()
+	q.Mapping = MapNearest
+	nearest, err := q.ToPaletted(16, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The palette is the same, only the mapping changes:
+	if !reflect.DeepEqual(box.Palette, nearest.Palette) {
+		t.Fatal(box.Palette, nearest.Palette)
+	}
+	if reflect.DeepEqual(box.Pix, nearest.Pix) {
+		t.Fatal()
+	}
+	if b, n := palettedMSE(img, box), palettedMSE(img, nearest); n >= b {
+		t.Fatal(b, n)
+	}
+}
+
+func TestConfigTransparent(t *testing.T) {
+	var (
+		red = color.RGBA{0xff, 0x00, 0x00, 0xff}
+		img = genHalves(20, 10, color.RGBA{0x10, 0x10, 0x10, 0x10}, red)
+	)
+
+	q := New()
+	q.Transparent = true
+	q.Exact = true
+	result, err := q.ToPaletted(4, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Palette, color.Palette{red, color.RGBA{}}) {
+		t.Fatal(result.Palette)
+	}
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 20; x++ {
+			if exp := uint8(1 - x/10); result.ColorIndexAt(x, y) != exp {
+				t.Fatal(x, y, result.ColorIndexAt(x, y))
+			}
+		}
+	}
+
+	// The transparent entry is only reserved if it is needed:
+	result, err = q.ToPaletted(4, genHalves(20, 10, red, red), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Palette, color.Palette{red}) {
+		t.Fatal(result.Palette)
+	}
+
+	if _, err := q.ToPaletted(1, img, nil); err == nil {
+		t.Fatal()
+	}
+
+	// QuantizeRGBA can't return the error, so it panics:
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal()
+			}
+		}()
+		q.QuantizeRGBA(make([]color.RGBA, 0, 1), img)
+	}()
+}
+
+func TestConfigDither(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 4), uint8(x * 4), uint8(x * 4), 0xff})
+		}
+	}
+
+	plain, err := New().ToPaletted(4, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := New()
+	q.Dither = true
+	dithered, err := q.ToPaletted(4, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plain.Palette, dithered.Palette) {
+		t.Fatal(plain.Palette, dithered.Palette)
+	}
+
+	// Dithering spreads the error so that each column averages out close to
+	// the original value, which mapping each pixel independently can't do:
+	columnError := func(p *image.Paletted) (sum float64) {
+		for x := 0; x < 64; x++ {
+			var mean float64
+			for y := 0; y < 16; y++ {
+				r, _, _, _ := p.At(x, y).RGBA()
+				mean += float64(r>>8) / 16
+			}
+			d := mean - float64(x*4)
+			sum += d * d
+		}
+		return sum
+	}
+	if p, d := columnError(plain), columnError(dithered); d >= p {
+		t.Fatal(p, d)
+	}
+}
+
+func TestConfigParallelism(t *testing.T) {
+	img := genRGBAWithRandomRGBPerPixel(rand.New(rand.NewSource(0)), 700, 500)
+	sub := img.SubImage(image.Rect(3, 5, 697, 499)).(*image.RGBA)
+
+	serial := New()
+	serial.Precise = true
+	exp, err := serial.ToPaletted(64, sub, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := New()
+	q.Precise = true
+	q.Parallelism = 3
+	for i := 0; i < 2; i++ {
+		result, err := q.ToPaletted(64, sub, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(exp.Palette, result.Palette) {
+			t.Fatal(i, exp.Palette, result.Palette)
+		}
+		if !reflect.DeepEqual(exp.Pix, result.Pix) {
+			t.Fatal(i)
+		}
+	}
+}
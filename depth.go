@@ -0,0 +1,164 @@
+package wu2quant
+
+import (
+	"fmt"
+	"image/color"
+)
+
+// Depth is the number of bits per channel a display can show. Palette entries
+// are snapped to the nearest colour representable at that depth. The zero
+// value leaves the palette at 8 bits per channel.
+type Depth struct {
+	R, G, B int
+}
+
+var (
+	// DepthRGB565 is the 16-bit format used by many embedded displays.
+	DepthRGB565 = Depth{R: 5, G: 6, B: 5}
+
+	// DepthRGB555 is the 15-bit format used by many consoles.
+	DepthRGB555 = Depth{R: 5, G: 5, B: 5}
+
+	// DepthRGB444 is 12-bit colour.
+	DepthRGB444 = Depth{R: 4, G: 4, B: 4}
+
+	// DepthRGB333 is 9-bit colour.
+	DepthRGB333 = Depth{R: 3, G: 3, B: 3}
+)
+
+func (d Depth) validate() error {
+	if d == (Depth{}) {
+		return nil
+	}
+	if d.R < 1 || d.R > 8 || d.G < 1 || d.G > 8 || d.B < 1 || d.B > 8 {
+		return fmt.Errorf("depth must be between 1 and 8 bits per channel; found %+v", d)
+	}
+	return nil
+}
+
+// snapChannel returns the 8-bit value nearest to v that can be represented with
+// the given number of bits.
+func snapChannel(v uint8, bits int) uint8 {
+	return expandChannel(reduceChannel(v, bits), bits)
+}
+
+// reduceChannel returns the level nearest to the 8-bit value v in a channel with
+// the given number of bits.
+func reduceChannel(v uint8, bits int) uint32 {
+	max := uint32(1)<<uint(bits) - 1
+	return (uint32(v)*max + 0x7f) / 0xff
+}
+
+// expandChannel returns the 8-bit value of level in a channel with the given
+// number of bits. The extremes map to 0 and 0xff.
+func expandChannel(level uint32, bits int) uint8 {
+	max := uint32(1)<<uint(bits) - 1
+	return uint8((level*0xff + max/2) / max)
+}
+
+// snap snaps each colour in into to q.Depth, merging colours that become the
+// same, then relabels q.tag with relabel. Snapping moves the colours away from
+// the boxes they were built from, so the nearest colour is not necessarily the
+// one belonging to the cell's box.
+//
+// q.hist must contain the moments calculated by palette.
+func (q *Quantizer) snap(into *quantizedColors) {
+	var (
+		d      = q.Depth
+		remap  [maxWideColors]paletteIndex
+		colors = make([]color.RGBA, 0, into.paletteSize)
+	)
+
+	for k := paletteIndex(0); k < into.paletteSize; k++ {
+		c := color.RGBA{
+			R: snapChannel(into.rLut[k], d.R),
+			G: snapChannel(into.gLut[k], d.G),
+			B: snapChannel(into.bLut[k], d.B),
+			A: 0xff,
+		}
+
+		found := false
+		for i, e := range colors {
+			if e == c {
+				remap[k], found = paletteIndex(i), true
+				break
+			}
+		}
+		if !found {
+			remap[k] = paletteIndex(len(colors))
+			colors = append(colors, c)
+		}
+	}
+
+	for i, c := range colors {
+		into.rLut[i], into.gLut[i], into.bLut[i] = c.R, c.G, c.B
+	}
+	into.paletteSize = paletteIndex(len(colors))
+
+	// Cells that weren't counted in the histogram keep their box, so that they
+	// are still mapped somewhere sensible if they are looked up:
+	for i := range q.tag {
+		q.tag[i] = remap[q.tag[i]]
+	}
+
+	q.relabel(into)
+}
+
+// relabel labels each occupied cell of the histogram in q.tag with the colour
+// in into nearest to the mean of the pixels in it.
+//
+// q.hist must contain the moments calculated by palette.
+func (q *Quantizer) relabel(into *quantizedColors) {
+	var (
+		w      = q.hist.weights
+		extent = q.hist.extent()
+		colors = make([]color.RGBA, into.paletteSize)
+	)
+	for i := range colors {
+		colors[i] = color.RGBA{R: into.rLut[i], G: into.gLut[i], B: into.bLut[i], A: 0xff}
+	}
+
+	for r := extent.rmin + 1; r <= extent.rmax; r++ {
+		for g := extent.gmin + 1; g <= extent.gmax; g++ {
+			for b := extent.bmin + 1; b <= extent.bmax; b++ {
+				cell := box{rmin: r - 1, rmax: r, gmin: g - 1, gmax: g, bmin: b - 1, bmax: b}
+				weight := vol(&cell, &q.hist.wt)
+				if weight == 0 {
+					continue
+				}
+				mr := int(q.hist.decode(vol(&cell, &q.hist.mr) / weight))
+				mg := int(q.hist.decode(vol(&cell, &q.hist.mg) / weight))
+				mb := int(q.hist.decode(vol(&cell, &q.hist.mb) / weight))
+				q.tag[q.hist.cellAt(r, g, b)] = nearestColor(colors, w, mr, mg, mb, false)
+			}
+		}
+	}
+}
+
+// PackRGB565 packs each colour in p into a 16-bit word with 5 bits of red in the
+// high bits, 6 of green and 5 of blue. Alpha is ignored.
+func PackRGB565(p color.Palette) []uint16 {
+	out := make([]uint16, len(p))
+	for i, c := range p {
+		r, g, b := paletteRGB(c)
+		out[i] = uint16(reduceChannel(r, 5)<<11 | reduceChannel(g, 6)<<5 | reduceChannel(b, 5))
+	}
+	return out
+}
+
+// PackRGB555 packs each colour in p into a 16-bit word with 5 bits each of red,
+// green and blue, red in the highest. The top bit is always zero. Alpha is
+// ignored.
+func PackRGB555(p color.Palette) []uint16 {
+	out := make([]uint16, len(p))
+	for i, c := range p {
+		r, g, b := paletteRGB(c)
+		out[i] = uint16(reduceChannel(r, 5)<<10 | reduceChannel(g, 5)<<5 | reduceChannel(b, 5))
+	}
+	return out
+}
+
+func paletteRGB(c color.Color) (r, g, b uint8) {
+	cr, cg, cb, _ := c.RGBA()
+	return uint8(cr >> 8), uint8(cg >> 8), uint8(cb >> 8)
+}
@@ -0,0 +1,114 @@
+package wu2quant
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+func TestDepth(t *testing.T) {
+	img := genRGBAWithRandomRGBPerPixel(rand.New(rand.NewSource(0)), 100, 100)
+
+	for _, depth := range []Depth{DepthRGB565, DepthRGB555, DepthRGB444, DepthRGB333, {R: 1, G: 2, B: 8}} {
+		q := New()
+		q.Depth = depth
+		result, err := q.ToPaletted(64, img, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seen := make(map[color.Color]bool)
+		colors := make([]color.RGBA, len(result.Palette))
+		for i, c := range result.Palette {
+			rgba := c.(color.RGBA)
+			if snapChannel(rgba.R, depth.R) != rgba.R || snapChannel(rgba.G, depth.G) != rgba.G || snapChannel(rgba.B, depth.B) != rgba.B {
+				t.Fatal(depth, c)
+			}
+			if seen[c] {
+				t.Fatal(depth, "duplicate", c)
+			}
+			seen[c] = true
+			colors[i] = rgba
+		}
+
+		max := 1 << uint(depth.R+depth.G+depth.B)
+		if len(result.Palette) > max {
+			t.Fatal(depth, len(result.Palette))
+		}
+
+		for _, idx := range result.Pix {
+			if int(idx) >= len(result.Palette) {
+				t.Fatal(depth, idx)
+			}
+		}
+	}
+}
+
+func TestDepthMapsToNearest(t *testing.T) {
+	pal := []color.RGBA{
+		{0x00, 0x00, 0x00, 0xff},
+		{0x10, 0x10, 0x10, 0xff},
+		{0xf0, 0x20, 0x30, 0xff},
+		{0xff, 0xff, 0xff, 0xff},
+	}
+	img := genRings(pal, 8)
+
+	q := New()
+	q.Depth = DepthRGB333
+	result, err := q.ToPaletted(4, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Black and the dark grey snap to the same colour:
+	if len(result.Palette) != 3 {
+		t.Fatal(result.Palette)
+	}
+
+	colors := make([]color.RGBA, len(result.Palette))
+	for i, c := range result.Palette {
+		colors[i] = c.(color.RGBA)
+	}
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			c := img.RGBAAt(x, y)
+			exp := nearestColor(colors, unitWeights, int(c.R), int(c.G), int(c.B), false)
+			if idx := result.ColorIndexAt(x, y); idx != uint8(exp) {
+				t.Fatal(x, y, idx, exp)
+			}
+		}
+	}
+}
+
+func TestDepthInvalid(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	for _, depth := range []Depth{{R: 5}, {R: 9, G: 8, B: 8}, {R: -1, G: 1, B: 1}} {
+		q := New()
+		q.Depth = depth
+		if _, err := q.ToPaletted(8, img, nil); err == nil {
+			t.Fatal(depth)
+		}
+	}
+}
+
+func TestPackRGB(t *testing.T) {
+	p := color.Palette{
+		color.RGBA{0xff, 0xff, 0xff, 0xff},
+		color.RGBA{0xff, 0x00, 0x00, 0xff},
+		color.RGBA{0x00, 0xff, 0x00, 0xff},
+		color.RGBA{0x00, 0x00, 0xff, 0xff},
+		color.RGBA{0x84, 0x82, 0x84, 0xff},
+	}
+
+	for i, exp := range []uint16{0xffff, 0xf800, 0x07e0, 0x001f, 0x8410} {
+		if v := PackRGB565(p)[i]; v != exp {
+			t.Fatalf("%d: %#04x != %#04x", i, v, exp)
+		}
+	}
+	for i, exp := range []uint16{0x7fff, 0x7c00, 0x03e0, 0x001f, 0x4210} {
+		if v := PackRGB555(p)[i]; v != exp {
+			t.Fatalf("%d: %#04x != %#04x", i, v, exp)
+		}
+	}
+}
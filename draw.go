@@ -0,0 +1,169 @@
+package wu2quant
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Drawer implements image/draw.Drawer. It draws any image.Image into an
+// *image.Paletted using the destination's existing palette, optionally with
+// Floyd-Steinberg error diffusion. It is similar to draw.FloydSteinberg, but
+// looks up colours in a table of the 32x32x32 cells Wu's algorithm uses rather
+// than searching the palette for every pixel.
+//
+// If the destination is not an *image.Paletted, or has an empty palette, Drawer
+// falls back to draw.Draw or draw.FloydSteinberg.
+//
+// The zero value draws using draw.Over without dithering. A Drawer caches the
+// lookup table for the last palette it was used with, so it is not safe for
+// concurrent use.
+type Drawer struct {
+	Op     draw.Op
+	Dither bool
+
+	// Weights scales each channel's contribution to the distance between colours
+	// when finding the nearest palette entry. Defaults to equal weights.
+	Weights ChannelWeights
+
+	lut nearestLUT
+}
+
+var _ draw.Drawer = &Drawer{}
+
+// Draw aligns r.Min in dst with sp in src and then replaces the rectangle r in
+// dst with the result of a Porter-Duff composition using d.Op, mapped to dst's
+// palette.
+func (d *Drawer) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
+	p, ok := dst.(*image.Paletted)
+	if !ok || len(p.Palette) == 0 {
+		if d.Dither && d.Op == draw.Src {
+			draw.FloydSteinberg.Draw(dst, r, src, sp)
+		} else {
+			draw.Draw(dst, r, src, sp, d.Op)
+		}
+		return
+	}
+
+	orig := r.Min
+	r = r.Intersect(p.Bounds())
+	r = r.Intersect(src.Bounds().Add(orig.Sub(sp)))
+	if r.Empty() {
+		return
+	}
+	sp = sp.Add(r.Min.Sub(orig))
+
+	d.lut.reset(p.Palette, d.Weights)
+	d.draw(p, r, srcRGBA(src, image.Rectangle{Min: sp, Max: sp.Add(r.Size())}), sp)
+}
+
+func (d *Drawer) draw(dst *image.Paletted, r image.Rectangle, src *image.RGBA, sp image.Point) {
+	var (
+		width  = r.Dx()
+		colors = d.lut.colors
+		over   = d.Op == draw.Over
+
+		// Floyd-Steinberg error, in 1/16ths, for the current and next rows. The
+		// extra element at each end saves bounds checks at the edges:
+		errCur, errNext []int32
+	)
+
+	if d.Dither {
+		errCur = make([]int32, (width+2)*3)
+		errNext = make([]int32, (width+2)*3)
+	}
+
+	for y := 0; y < r.Dy(); y++ {
+		si := src.PixOffset(sp.X, sp.Y+y)
+		di := dst.PixOffset(r.Min.X, r.Min.Y+y)
+
+		for x := 0; x < width; x, si, di = x+1, si+4, di+1 {
+			sr, sg, sb, sa := int32(src.Pix[si]), int32(src.Pix[si+1]), int32(src.Pix[si+2]), int32(src.Pix[si+3])
+
+			if over && sa != 0xff && int(dst.Pix[di]) < len(colors) {
+				dc := colors[dst.Pix[di]]
+				ia := 0xff - sa
+				sr += (int32(dc.R)*ia + 0x7f) / 0xff
+				sg += (int32(dc.G)*ia + 0x7f) / 0xff
+				sb += (int32(dc.B)*ia + 0x7f) / 0xff
+				sa += (int32(dc.A)*ia + 0x7f) / 0xff
+			}
+
+			if sa < 0x80 && d.lut.transparent >= 0 {
+				dst.Pix[di] = uint8(d.lut.transparent)
+				continue
+			}
+
+			if d.Dither {
+				e := (x + 1) * 3
+				sr = clamp8(sr + (errCur[e]+8)/16)
+				sg = clamp8(sg + (errCur[e+1]+8)/16)
+				sb = clamp8(sb + (errCur[e+2]+8)/16)
+			}
+
+			idx := d.lut.index(uint8(sr), uint8(sg), uint8(sb))
+			dst.Pix[di] = uint8(idx)
+
+			if d.Dither {
+				c := colors[idx]
+				er, eg, eb := sr-int32(c.R), sg-int32(c.G), sb-int32(c.B)
+				e := (x + 1) * 3
+
+				errCur[e+3] += er * 7
+				errCur[e+4] += eg * 7
+				errCur[e+5] += eb * 7
+				errNext[e-3] += er * 3
+				errNext[e-2] += eg * 3
+				errNext[e-1] += eb * 3
+				errNext[e] += er * 5
+				errNext[e+1] += eg * 5
+				errNext[e+2] += eb * 5
+				errNext[e+3] += er
+				errNext[e+4] += eg
+				errNext[e+5] += eb
+			}
+		}
+
+		if d.Dither {
+			errCur, errNext = errNext, errCur
+			for i := range errNext {
+				errNext[i] = 0
+			}
+		}
+	}
+}
+
+func clamp8(v int32) int32 {
+	if v < 0 {
+		return 0
+	} else if v > 0xff {
+		return 0xff
+	}
+	return v
+}
+
+type subImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
+
+// boundedImage restricts an image with no SubImage method, like *image.Uniform,
+// to the bounds r.
+type boundedImage struct {
+	image.Image
+	r image.Rectangle
+}
+
+func (b boundedImage) Bounds() image.Rectangle { return b.r }
+
+// srcRGBA returns an *image.RGBA containing at least the pixels of src inside r,
+// converting only that part of src if src is not already an *image.RGBA.
+func srcRGBA(src image.Image, r image.Rectangle) *image.RGBA {
+	if rgba, ok := src.(*image.RGBA); ok {
+		return rgba
+	}
+	if sub, ok := src.(subImager); ok {
+		src = sub.SubImage(r)
+	} else {
+		src = boundedImage{src, r}
+	}
+	return convertToRGBA(src)
+}
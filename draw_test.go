@@ -0,0 +1,169 @@
+package wu2quant
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"testing"
+)
+
+func TestDrawerSrc(t *testing.T) {
+	pal := genRandomRGBAPalette(rand.New(rand.NewSource(0)), 10)
+	src := genRings(pal, 10)
+
+	palette := make(color.Palette, len(pal))
+	for i, c := range pal {
+		palette[i] = c
+	}
+	dst := image.NewPaletted(src.Bounds(), palette)
+
+	d := &Drawer{Op: draw.Src}
+	d.Draw(dst, dst.Bounds(), src, image.Point{})
+
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			if dst.At(x, y) != src.At(x, y) {
+				t.Fatal(x, y, dst.At(x, y), src.At(x, y))
+			}
+		}
+	}
+}
+
+func TestDrawerPaletteColorsInSameCell(t *testing.T) {
+	// Both entries fall in the same cell, and the second is nearer its centre,
+	// but colours equal to the first must still map to it:
+	palette := color.Palette{
+		color.RGBA{0x00, 0x00, 0x00, 0xff},
+		color.RGBA{0x06, 0x06, 0x06, 0xff},
+		color.RGBA{0xff, 0xff, 0xff, 0xff},
+	}
+	src := image.NewRGBA(image.Rect(0, 0, 3, 1))
+	for i, c := range palette {
+		src.Set(i, 0, c)
+	}
+
+	for _, dither := range []bool{false, true} {
+		dst := image.NewPaletted(src.Bounds(), palette)
+		d := &Drawer{Op: draw.Src, Dither: dither}
+		d.Draw(dst, dst.Bounds(), src, image.Point{})
+
+		for i := range palette {
+			if dst.Pix[i] != uint8(i) {
+				t.Fatal(dither, i, dst.Pix[i])
+			}
+		}
+	}
+}
+
+func TestDrawerClip(t *testing.T) {
+	src := image.NewUniform(color.RGBA{0xff, 0xff, 0xff, 0xff})
+	dst := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White})
+
+	d := &Drawer{Op: draw.Src}
+	d.Draw(dst, image.Rect(2, 2, 10, 10), src, image.Point{})
+
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			exp := uint8(0)
+			if x >= 2 && y >= 2 {
+				exp = 1
+			}
+			if dst.ColorIndexAt(x, y) != exp {
+				t.Fatal(x, y)
+			}
+		}
+	}
+}
+
+func TestDrawerOver(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	src.SetRGBA(1, 1, color.RGBA{0xff, 0xff, 0xff, 0xff})
+
+	dst := image.NewPaletted(src.Bounds(), color.Palette{color.White, color.Black})
+	for i := range dst.Pix {
+		dst.Pix[i] = 1
+	}
+
+	var d Drawer
+	d.Draw(dst, dst.Bounds(), src, image.Point{})
+
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			exp := uint8(1)
+			if x == 1 && y == 1 {
+				exp = 0
+			}
+			if dst.ColorIndexAt(x, y) != exp {
+				t.Fatal(x, y)
+			}
+		}
+	}
+}
+
+func TestDrawerTransparent(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.SetRGBA(0, 0, color.RGBA{0xff, 0xff, 0xff, 0xff})
+
+	dst := image.NewPaletted(src.Bounds(), color.Palette{color.White, color.Transparent})
+
+	d := &Drawer{Op: draw.Src}
+	d.Draw(dst, dst.Bounds(), src, image.Point{})
+	if dst.Pix[0] != 0 || dst.Pix[1] != 1 {
+		t.Fatal(dst.Pix)
+	}
+}
+
+func TestDrawerDither(t *testing.T) {
+	src := image.NewUniform(color.RGBA{0x80, 0x80, 0x80, 0xff})
+	dst := image.NewPaletted(image.Rect(0, 0, 32, 32), color.Palette{color.Black, color.White})
+
+	d := &Drawer{Op: draw.Src, Dither: true}
+	d.Draw(dst, dst.Bounds(), src, image.Point{})
+
+	var white int
+	for _, idx := range dst.Pix {
+		white += int(idx)
+	}
+
+	// Roughly half the pixels should be white:
+	if white < 480 || white > 544 {
+		t.Fatal(white)
+	}
+}
+
+func TestDrawerFallback(t *testing.T) {
+	src := image.NewUniform(color.RGBA{0x80, 0x80, 0x80, 0xff})
+	dst := image.NewRGBA(image.Rect(0, 0, 2, 2))
+
+	d := &Drawer{Op: draw.Src}
+	d.Draw(dst, dst.Bounds(), src, image.Point{})
+	if dst.RGBAAt(1, 1) != (color.RGBA{0x80, 0x80, 0x80, 0xff}) {
+		t.Fatal()
+	}
+}
+
+func BenchmarkDrawerDither(b *testing.B) {
+	b.ReportAllocs()
+	img := genRGBAWithUniqueRGBPerPixel(512, 256)
+	pal := New().Quantize(make(color.Palette, 0, 256), img)
+	dst := image.NewPaletted(img.Rect, pal)
+	d := &Drawer{Op: draw.Src, Dither: true}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Draw(dst, dst.Bounds(), img, image.Point{})
+	}
+}
+
+func BenchmarkStdlibFloydSteinberg(b *testing.B) {
+	b.ReportAllocs()
+	img := genRGBAWithUniqueRGBPerPixel(512, 256)
+	pal := New().Quantize(make(color.Palette, 0, 256), img)
+	dst := image.NewPaletted(img.Rect, pal)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		draw.FloydSteinberg.Draw(dst, dst.Bounds(), img, image.Point{})
+	}
+}
@@ -0,0 +1,156 @@
+package wu2quant
+
+import (
+	"fmt"
+	"image"
+)
+
+// PaletteGenerator selects how the palette is chosen. Wu's algorithm adapts
+// the palette to the colours of the image; the other generators produce fixed
+// palettes of evenly spaced colours, which are useful for posterization and for
+// comparison.
+type PaletteGenerator int
+
+const (
+	// GeneratorWu builds the palette from the image with Wu's algorithm.
+	GeneratorWu PaletteGenerator = iota
+
+	// GeneratorUniform divides the RGB cube into as many evenly spaced levels
+	// per channel as fit in the palette, giving green an extra level and then
+	// red if there is room.
+	GeneratorUniform
+
+	// GeneratorWebSafe is the 216 colour web-safe palette, with 6 levels per
+	// channel.
+	GeneratorWebSafe
+
+	// GeneratorLevels posterizes the image to the number of evenly spaced levels
+	// per channel given by Config.Levels.
+	GeneratorLevels
+)
+
+// Levels is the number of evenly spaced values of each channel used by
+// GeneratorLevels, including 0 and 255. Each must be between 2 and 256, and the
+// palette must have room for R*G*B colours.
+type Levels struct {
+	R, G, B int
+}
+
+var webSafeLevels = Levels{R: 6, G: 6, B: 6}
+
+func (l Levels) validate() error {
+	if l.R < 2 || l.R > 256 || l.G < 2 || l.G > 256 || l.B < 2 || l.B > 256 {
+		return fmt.Errorf("levels must be between 2 and 256 per channel; found %+v", l)
+	}
+	return nil
+}
+
+// colors returns the number of colours in the palette for l.
+func (l Levels) colors() int {
+	return l.R * l.G * l.B
+}
+
+// uniformLevels returns the most levels per channel that fit in a palette of
+// paletteColors, favouring green then red. At least 2 levels are returned for
+// each channel, even if they don't fit.
+func uniformLevels(paletteColors int) Levels {
+	k := 2
+	for (k+1)*(k+1)*(k+1) <= paletteColors {
+		k++
+	}
+	l := Levels{R: k, G: k, B: k}
+	if k*(k+1)*k <= paletteColors {
+		l.G++
+		if (k+1)*(k+1)*k <= paletteColors {
+			l.R++
+		}
+	}
+	return l
+}
+
+// requireWu returns an error if c.Generator is not GeneratorWu, for the entry
+// points that always build the palette from a histogram with Wu's algorithm.
+func (c *Config) requireWu(name string) error {
+	if c.Generator != GeneratorWu {
+		return fmt.Errorf("%s only supports GeneratorWu; found generator %d", name, c.Generator)
+	}
+	return nil
+}
+
+// levelColors fills into with the palette for q.Generator, which must not be
+// GeneratorWu. Entry (r*l.G+g)*l.B+b has level r of red, g of green and b of
+// blue.
+func (q *Quantizer) levelColors(into *quantizedColors, paletteColors int) error {
+	var l Levels
+	switch q.Generator {
+	case GeneratorWebSafe:
+		l = webSafeLevels
+	case GeneratorLevels:
+		l = q.Levels
+	default:
+		l = uniformLevels(paletteColors)
+	}
+	if l.colors() > paletteColors {
+		return fmt.Errorf("levels %+v need %d colours; palette size is %d", l, l.colors(), paletteColors)
+	}
+
+	k := 0
+	for r := 0; r < l.R; r++ {
+		for g := 0; g < l.G; g++ {
+			for b := 0; b < l.B; b++ {
+				into.rLut[k], into.gLut[k], into.bLut[k] = levelValue(r, l.R), levelValue(g, l.G), levelValue(b, l.B)
+				k++
+			}
+		}
+	}
+	into.paletteSize = paletteIndex(k)
+	into.mapping = mapLevels
+	into.levels = l
+
+	return nil
+}
+
+// levelValue returns the 8-bit value of level i of n.
+func levelValue(i, n int) uint8 {
+	return uint8((i*0xff + (n-1)/2) / (n - 1))
+}
+
+// levelTable holds, for each 8-bit value of each channel, the contribution of
+// the level nearest to it to the palette index, so that the index of a colour
+// is the sum of its three entries.
+type levelTable [3][256]paletteIndex
+
+func (l Levels) table() *levelTable {
+	var (
+		t       levelTable
+		strides = [3]int{l.G * l.B, l.B, 1}
+	)
+	for c, n := range [3]int{l.R, l.G, l.B} {
+		for v := range t[c] {
+			t[c][v] = paletteIndex((v*(n-1) + 0x7f) / 0xff * strides[c])
+		}
+	}
+	return &t
+}
+
+func (t *levelTable) index(r, g, b uint8) paletteIndex {
+	return t[0][r] + t[1][g] + t[2][b]
+}
+
+// mapToLevels is like mapPixels, but finds the nearest level of each channel of
+// each pixel in m.
+func mapToLevels(o *image.Paletted, m *image.RGBA, l Levels, mask *image.Alpha) {
+	var (
+		bounds = m.Bounds()
+		t      = l.table()
+	)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		pix := m.Pix[m.PixOffset(bounds.Min.X, y):][:bounds.Dx()*4]
+		row := o.Pix[o.PixOffset(bounds.Min.X, y):][:bounds.Dx()]
+		for x := range row {
+			if !maskedOut(mask, bounds.Min.X+x, y) {
+				row[x] = uint8(t.index(pix[x*4], pix[x*4+1], pix[x*4+2]))
+			}
+		}
+	}
+}
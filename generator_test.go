@@ -0,0 +1,191 @@
+package wu2quant
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestUniformLevels(t *testing.T) {
+	for _, tc := range []struct {
+		colors int
+		exp    Levels
+	}{
+		{8, Levels{2, 2, 2}},
+		{27, Levels{3, 3, 3}},
+		{36, Levels{3, 4, 3}},
+		{48, Levels{4, 4, 3}},
+		{64, Levels{4, 4, 4}},
+		{256, Levels{6, 7, 6}},
+	} {
+		if l := uniformLevels(tc.colors); l != tc.exp {
+			t.Fatal(tc.colors, l)
+		}
+	}
+}
+
+// checkLevels fails if any pixel of p is not the nearest level of each channel
+// of the same pixel in img.
+func checkLevels(t *testing.T, img *image.RGBA, p *image.Paletted, l Levels) {
+	t.Helper()
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			in, out := img.RGBAAt(x, y), p.At(x, y).(color.RGBA)
+			for c, pair := range [3][2]uint8{{in.R, out.R}, {in.G, out.G}, {in.B, out.B}} {
+				n := [3]int{l.R, l.G, l.B}[c]
+				step := 0xff / float64(n-1)
+				if d := float64(pair[0]) - float64(pair[1]); d > step/2+1 || d < -step/2-1 {
+					t.Fatal(x, y, c, in, out)
+				}
+			}
+		}
+	}
+}
+
+func TestGenerators(t *testing.T) {
+	img := genRGBAWithRandomRGBPerPixel(rand.New(rand.NewSource(0)), 40, 30)
+
+	for _, tc := range []struct {
+		generator PaletteGenerator
+		levels    Levels
+		colors    int
+		exp       Levels
+	}{
+		{GeneratorUniform, Levels{}, 64, Levels{4, 4, 4}},
+		{GeneratorWebSafe, Levels{}, 256, webSafeLevels},
+		{GeneratorLevels, Levels{2, 3, 4}, 24, Levels{2, 3, 4}},
+	} {
+		q := New()
+		q.Generator = tc.generator
+		q.Levels = tc.levels
+		result, err := q.ToPaletted(tc.colors, img, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Palette) != tc.exp.colors() {
+			t.Fatal(tc.generator, len(result.Palette))
+		}
+		checkLevels(t, img, result, tc.exp)
+
+		// The same palette is produced for any image:
+		other, err := q.ToPaletted(tc.colors, image.NewRGBA(image.Rect(0, 0, 1, 1)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(result.Palette, other.Palette) {
+			t.Fatal(tc.generator)
+		}
+	}
+}
+
+func TestGeneratorWebSafePalette(t *testing.T) {
+	q := New()
+	q.Generator = GeneratorWebSafe
+	result, err := q.ToPaletted(0, image.NewRGBA(image.Rect(0, 0, 1, 1)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range result.Palette {
+		c := c.(color.RGBA)
+		if c.R%0x33 != 0 || c.G%0x33 != 0 || c.B%0x33 != 0 {
+			t.Fatal(i, c)
+		}
+		if i == 1 && c != (color.RGBA{0, 0, 0x33, 0xff}) {
+			t.Fatal(c)
+		}
+	}
+}
+
+func TestGeneratorOptions(t *testing.T) {
+	img := genRGBAWithRandomRGBPerPixel(rand.New(rand.NewSource(0)), 40, 30)
+	img.Pix[3] = 0
+
+	q := New()
+	q.Generator = GeneratorWebSafe
+	q.Transparent = true
+	q.Dither = true
+	result, err := q.ToPaletted(256, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Palette) != 217 || result.Palette[216] != (color.RGBA{}) {
+		t.Fatal(len(result.Palette))
+	}
+	if result.Pix[0] != 216 {
+		t.Fatal(result.Pix[0])
+	}
+
+	// Indices beyond 256 colours:
+	q = New()
+	q.Generator = GeneratorLevels
+	q.Levels = Levels{16, 16, 16}
+	indices := make([]uint16, 40*30)
+	pal, err := q.RGBAToIndices16(4096, img, nil, indices, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, idx := range indices {
+		in, out := img.Pix[i*4:], pal[idx]
+		for c, v := range [3]uint8{out.R, out.G, out.B} {
+			if exp := levelValue((int(in[c])*15+0x7f)/0xff, 16); v != exp {
+				t.Fatal(i, c, in[c], v, exp)
+			}
+		}
+	}
+}
+
+func TestGeneratorInvalid(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	for i, c := range []Config{
+		{Generator: GeneratorLevels + 1},
+		{Generator: GeneratorLevels},
+		{Generator: GeneratorLevels, Levels: Levels{2, 1, 2}},
+		{Generator: GeneratorLevels, Levels: Levels{8, 8, 8}},
+		{Generator: GeneratorWebSafe, Colors: 200},
+		{Generator: GeneratorUniform, Colors: 7},
+	} {
+		q := &Quantizer{Config: c}
+		if _, err := q.ToPaletted(0, img, nil); err == nil {
+			t.Fatal(i)
+		}
+	}
+}
+
+func TestGeneratorUnsupported(t *testing.T) {
+	img := genRGBAWithUniqueRGBPerPixel(16, 16)
+	h := NewHistogram()
+	h.Add(img)
+
+	q := New()
+	q.Generator = GeneratorUniform
+
+	if _, err := q.ToGIF([]image.Image{img}, []int{0}, nil); err == nil {
+		t.Fatal()
+	}
+	if _, err := q.ToTiled(img, nil); err == nil {
+		t.Fatal()
+	}
+	if _, err := q.HistogramPalette(16, h); err == nil {
+		t.Fatal()
+	}
+	if _, err := q.HistogramMapper(16, h); err == nil {
+		t.Fatal()
+	}
+	if _, err := NewSequence(q, 16, 0).RGBAToPaletted(img, nil); err == nil {
+		t.Fatal()
+	}
+	s := NewStream(q)
+	if err := s.Add(img); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Palette(16); err == nil {
+		t.Fatal()
+	}
+
+	// Quantize supports every generator:
+	if pal := q.Quantize(make(color.Palette, 0, 64), img); len(pal) != 64 {
+		t.Fatal(len(pal))
+	}
+}
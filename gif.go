@@ -0,0 +1,276 @@
+package wu2quant
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+)
+
+// GIFOptions controls how ToGIF builds an animation. The zero value is valid, and
+// produces one palette of the Quantizer's Colors per frame with every frame
+// emitted in full.
+type GIFOptions struct {
+	// Colors is the number of entries in each palette, including the transparent
+	// entry if one is required. If zero, the Quantizer's Colors is used.
+	Colors int
+
+	// GlobalPalette builds a single palette from a histogram shared by all frames
+	// and uses it as the GIF's global color table. If false, each frame is
+	// given its own local palette.
+	GlobalPalette bool
+
+	// Optimize emits only the smallest rectangle of each frame that differs from
+	// the previous frame.
+	//
+	// If any frame contains transparent pixels, pixels inside the rectangle that
+	// have not changed are also written as the transparent index, so that the
+	// previous frame shows through them. A frame that makes a visible pixel
+	// transparent can't be drawn over the previous one, so the previous frame is
+	// emitted in full and disposed to the background instead.
+	Optimize bool
+
+	// LoopCount is passed through to gif.GIF.LoopCount.
+	LoopCount int
+}
+
+// ToGIF quantizes a sequence of frames into an animated GIF suitable for passing
+// to gif.EncodeAll. delays contains the delay for each frame in 100ths of a
+// second, and must be the same length as frames. All frames must have the same
+// bounds.
+//
+// Pixels with an alpha value below 50% are mapped to a transparent palette entry,
+// which is reserved only if at least one frame needs it. This happens whether or
+// not the Quantizer's Transparent is set.
+//
+// The Quantizer's Dither, Exact, Sample, Parallelism, PaletteMask and MapMask
+// are ignored.
+//
+// If a frame is not an *image.RGBA, it will be converted to one before quantization.
+// Depending on the image type, this may trigger very slow code paths.
+func (q *Quantizer) ToGIF(frames []image.Image, delays []int, opts *GIFOptions) (*gif.GIF, error) {
+	var o GIFOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.Colors = q.paletteColors(o.Colors)
+	if err := q.validate(o.Colors); err != nil {
+		return nil, fmt.Errorf("wu2quant: %w", err)
+	}
+	if err := q.requireWu("ToGIF"); err != nil {
+		return nil, fmt.Errorf("wu2quant: %w", err)
+	}
+
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("wu2quant: no frames to encode")
+	}
+	if len(delays) != len(frames) {
+		return nil, fmt.Errorf("wu2quant: found %d delays for %d frames", len(delays), len(frames))
+	}
+
+	var (
+		bounds      = frames[0].Bounds()
+		rgbas       = make([]*image.RGBA, len(frames))
+		transparent bool
+	)
+
+	for i, frame := range frames {
+		if frame.Bounds() != bounds {
+			return nil, fmt.Errorf("wu2quant: frame %d bounds %v did not match first frame bounds %v", i, frame.Bounds(), bounds)
+		}
+		rgbas[i] = convertToRGBA(frame)
+		if !transparent {
+			transparent = hasTransparency(rgbas[i])
+		}
+	}
+
+	wuColors := o.Colors
+	disposal := byte(gif.DisposalNone)
+	var clears []bool
+	if transparent {
+		if wuColors < 2 {
+			return nil, fmt.Errorf("wu2quant: frames contain transparency, palette size must be at least 2; found %d", o.Colors)
+		}
+		wuColors--
+		disposal = gif.DisposalBackground
+
+		// clears[i] is set if frame i makes a pixel transparent that was visible
+		// in frame i-1, in which case frame i-1 must be disposed before frame i
+		// is drawn. The last frame is compared with the first, which follows it
+		// when the animation loops:
+		if o.Optimize {
+			clears = make([]bool, len(rgbas)+1)
+			for i := 1; i <= len(rgbas); i++ {
+				clears[i] = clearsPixels(rgbas[i-1], rgbas[i%len(rgbas)])
+			}
+		}
+	}
+
+	out := &gif.GIF{
+		Image:     make([]*image.Paletted, len(frames)),
+		Delay:     append([]int(nil), delays...),
+		Disposal:  make([]byte, len(frames)),
+		LoopCount: o.LoopCount,
+		Config: image.Config{
+			Width:  bounds.Max.X,
+			Height: bounds.Max.Y,
+		},
+	}
+
+	var (
+		cols   quantizedColors
+		global color.Palette
+	)
+
+	if o.GlobalPalette {
+		q.reset()
+		for _, m := range rgbas {
+			q.hist.buildOpaque(m, alphaThreshold)
+		}
+		q.palette(&cols, wuColors)
+		global = gifPalette(&cols, o.Colors, transparent)
+		out.Config.ColorModel = global
+	}
+
+	for i, m := range rgbas {
+		var (
+			rect = bounds
+			prev *image.RGBA
+		)
+		if o.Optimize && i > 0 {
+			switch {
+			case !transparent:
+				rect = diffRect(rgbas[i-1], m)
+			case !clears[i] && !clears[i+1]:
+				rect = diffRect(rgbas[i-1], m)
+				prev = rgbas[i-1]
+			}
+		}
+		if clears != nil {
+			disposal = gif.DisposalNone
+			if clears[i+1] {
+				disposal = gif.DisposalBackground
+			}
+		}
+		sub := m.SubImage(rect).(*image.RGBA)
+
+		pal := global
+		if pal == nil {
+			q.reset()
+			q.hist.buildOpaque(sub, alphaThreshold)
+			q.palette(&cols, wuColors)
+			pal = gifPalette(&cols, o.Colors, transparent)
+		}
+
+		frame := image.NewPaletted(rect, pal)
+		q.mapOpaque(frame, sub, prev, uint8(len(pal)-1))
+
+		out.Image[i] = frame
+		out.Disposal[i] = disposal
+	}
+
+	return out, nil
+}
+
+func gifPalette(cols *quantizedColors, colors int, transparent bool) color.Palette {
+	pal := cols.appendTo(make(color.Palette, 0, colors))
+	if transparent {
+		// image/gif uses the palette entry with zero alpha as the transparent index:
+		pal = append(pal, color.RGBA{})
+	}
+	return pal
+}
+
+// buildOpaque is like build, but skips pixels with an alpha value below threshold.
+func (hist *histogram3D) buildOpaque(img *image.RGBA, threshold uint8) {
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		idx := img.PixOffset(bounds.Min.X, y)
+		end := idx + bounds.Dx()*4
+		for ; idx < end; idx += 4 {
+			if img.Pix[idx+3] < threshold {
+				continue
+			}
+			hist.add(int64(img.Pix[idx]), int64(img.Pix[idx+1]), int64(img.Pix[idx+2]))
+		}
+	}
+}
+
+// mapOpaque writes the palette index of each pixel in m to the pixel with the same
+// coordinates in o, using the table built by the most recent call to palette.
+// Pixels with an alpha value below alphaThreshold are written as transparentIndex,
+// as are pixels that are the same as in prev, if prev is not nil.
+func (q *Quantizer) mapOpaque(o *image.Paletted, m, prev *image.RGBA, transparentIndex uint8) {
+	bounds := m.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		src := m.PixOffset(bounds.Min.X, y)
+		dst := o.PixOffset(bounds.Min.X, y)
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if m.Pix[src+3] < alphaThreshold || (prev != nil && samePixel(m, prev, x, y)) {
+				o.Pix[dst] = transparentIndex
+			} else {
+				o.Pix[dst] = uint8(q.tag[cellIndex(m.Pix[src], m.Pix[src+1], m.Pix[src+2])])
+			}
+			src += 4
+			dst++
+		}
+	}
+}
+
+// samePixel reports whether the pixels at x, y in a and b are identical.
+func samePixel(a, b *image.RGBA, x, y int) bool {
+	ai, bi := a.PixOffset(x, y), b.PixOffset(x, y)
+	return a.Pix[ai] == b.Pix[bi] && a.Pix[ai+1] == b.Pix[bi+1] &&
+		a.Pix[ai+2] == b.Pix[bi+2] && a.Pix[ai+3] == b.Pix[bi+3]
+}
+
+// clearsPixels reports whether any pixel that is visible in prev is transparent
+// in next, which must have the same bounds.
+func clearsPixels(prev, next *image.RGBA) bool {
+	bounds := prev.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		idx := prev.PixOffset(bounds.Min.X, y)
+		end := idx + bounds.Dx()*4
+		for ; idx < end; idx += 4 {
+			if prev.Pix[idx+3] >= alphaThreshold && next.Pix[idx+3] < alphaThreshold {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// diffRect returns the smallest rectangle containing every pixel that differs
+// between a and b, which must have the same bounds. If the images are identical,
+// a single pixel rectangle at the origin is returned, as GIF frames may not be
+// empty.
+func diffRect(a, b *image.RGBA) image.Rectangle {
+	bounds := a.Bounds()
+	minX, minY, maxX, maxY := bounds.Max.X, bounds.Max.Y, bounds.Min.X-1, bounds.Min.Y-1
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		ai, bi := a.PixOffset(bounds.Min.X, y), b.PixOffset(bounds.Min.X, y)
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if a.Pix[ai] != b.Pix[bi] || a.Pix[ai+1] != b.Pix[bi+1] ||
+				a.Pix[ai+2] != b.Pix[bi+2] || a.Pix[ai+3] != b.Pix[bi+3] {
+				if x < minX {
+					minX = x
+				}
+				if x > maxX {
+					maxX = x
+				}
+				if y < minY {
+					minY = y
+				}
+				maxY = y
+			}
+			ai += 4
+			bi += 4
+		}
+	}
+
+	if maxY < minY {
+		return image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Min.X+1, bounds.Min.Y+1)
+	}
+	return image.Rect(minX, minY, maxX+1, maxY+1)
+}
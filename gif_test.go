@@ -0,0 +1,263 @@
+package wu2quant
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func genGIFFrames(n, w, h int) []image.Image {
+	rng := rand.New(rand.NewSource(0))
+	base := genRGBAWithRandomRGBPerPixel(rng, w, h)
+
+	frames := make([]image.Image, n)
+	for i := range frames {
+		frame := image.NewRGBA(base.Rect)
+		copy(frame.Pix, base.Pix)
+
+		// Each frame differs from the last in a small square that moves along
+		// the diagonal:
+		for y := i; y < i+4; y++ {
+			for x := i; x < i+4; x++ {
+				frame.SetRGBA(x, y, color.RGBA{0xff, 0, 0, 0xff})
+			}
+		}
+		frames[i] = frame
+	}
+	return frames
+}
+
+func TestToGIFGlobalPalette(t *testing.T) {
+	frames := genGIFFrames(4, 32, 32)
+	delays := []int{10, 10, 10, 10}
+
+	g, err := New().ToGIF(frames, delays, &GIFOptions{Colors: 16, GlobalPalette: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	global, ok := g.Config.ColorModel.(color.Palette)
+	if !ok || len(global) != 16 {
+		t.Fatal(g.Config.ColorModel)
+	}
+	for i, frame := range g.Image {
+		if !reflect.DeepEqual(frame.Palette, global) {
+			t.Fatal(i)
+		}
+		if frame.Bounds() != frames[i].Bounds() {
+			t.Fatal(i, frame.Bounds())
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gif.DecodeAll(&buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestToGIFLocalPalettes(t *testing.T) {
+	frames := genGIFFrames(3, 32, 32)
+
+	q := New()
+	g, err := q.ToGIF(frames, []int{5, 5, 5}, &GIFOptions{Colors: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Config.ColorModel != nil {
+		t.Fatal()
+	}
+
+	// Each frame should match what ToPaletted produces for it on its own:
+	for i, frame := range g.Image {
+		exp, err := New().ToPaletted(8, frames[i], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(exp.Palette, frame.Palette) || !reflect.DeepEqual(exp.Pix, frame.Pix) {
+			t.Fatal(i)
+		}
+	}
+}
+
+func TestToGIFOptimize(t *testing.T) {
+	frames := genGIFFrames(3, 32, 32)
+
+	g, err := New().ToGIF(frames, []int{5, 5, 5}, &GIFOptions{Colors: 8, GlobalPalette: true, Optimize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []image.Rectangle{
+		image.Rect(0, 0, 32, 32),
+		image.Rect(0, 0, 5, 5),
+		image.Rect(1, 1, 6, 6),
+	}
+	for i, frame := range g.Image {
+		if frame.Bounds() != expected[i] {
+			t.Fatal(i, frame.Bounds())
+		}
+		if g.Disposal[i] != gif.DisposalNone {
+			t.Fatal(i)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestToGIFTransparency(t *testing.T) {
+	frames := genGIFFrames(2, 16, 16)
+	frames[1].(*image.RGBA).SetRGBA(15, 15, color.RGBA{})
+
+	g, err := New().ToGIF(frames, []int{5, 5}, &GIFOptions{Colors: 4, Optimize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Frame 1 clears a pixel frame 0 drew, so both must be emitted in full and
+	// frame 0 disposed:
+	disposals := []byte{gif.DisposalBackground, gif.DisposalNone}
+	for i, frame := range g.Image {
+		if frame.Bounds() != frames[i].Bounds() {
+			t.Fatal(i, frame.Bounds())
+		}
+		if g.Disposal[i] != disposals[i] {
+			t.Fatal(i)
+		}
+		if len(frame.Palette) != 4 || frame.Palette[3] != (color.RGBA{}) {
+			t.Fatal(i, frame.Palette)
+		}
+	}
+	if g.Image[1].ColorIndexAt(15, 15) != 3 {
+		t.Fatal()
+	}
+	if g.Image[0].ColorIndexAt(15, 15) == 3 {
+		t.Fatal()
+	}
+}
+
+// compositeGIF returns the canvas after each frame of g is drawn, following the
+// disposal of the frame before it.
+func compositeGIF(g *gif.GIF) []*image.RGBA {
+	var (
+		canvas = image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+		out    = make([]*image.RGBA, len(g.Image))
+	)
+	for i, frame := range g.Image {
+		if i > 0 && g.Disposal[i-1] == gif.DisposalBackground {
+			draw.Draw(canvas, g.Image[i-1].Bounds(), image.Transparent, image.Point{}, draw.Src)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		out[i] = image.NewRGBA(canvas.Rect)
+		copy(out[i].Pix, canvas.Pix)
+	}
+	return out
+}
+
+func TestToGIFOptimizeTransparency(t *testing.T) {
+	// A sprite on a transparent background that grows for three frames, then
+	// shrinks back, which clears pixels it drew before:
+	sizes := []int{2, 4, 6, 6, 3}
+	frames := make([]image.Image, len(sizes))
+	for i, size := range sizes {
+		frame := image.NewRGBA(image.Rect(0, 0, 16, 16))
+		for y := 4; y < 4+size; y++ {
+			for x := 4; x < 4+size; x++ {
+				frame.SetRGBA(x, y, color.RGBA{uint8(0x40 * (x % 4)), 0x80, uint8(0x30 * i), 0xff})
+			}
+		}
+		frames[i] = frame
+	}
+	delays := make([]int, len(frames))
+
+	full, err := New().ToGIF(frames, delays, &GIFOptions{Colors: 32, GlobalPalette: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt, err := New().ToGIF(frames, delays, &GIFOptions{Colors: 32, GlobalPalette: true, Optimize: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []image.Rectangle{
+		image.Rect(0, 0, 16, 16),
+		image.Rect(4, 4, 8, 8),
+		image.Rect(4, 4, 10, 10),
+		image.Rect(0, 0, 16, 16),
+		image.Rect(0, 0, 16, 16),
+	}
+	disposals := []byte{
+		gif.DisposalNone,
+		gif.DisposalNone,
+		gif.DisposalNone,
+		gif.DisposalBackground,
+		gif.DisposalBackground,
+	}
+	for i, frame := range opt.Image {
+		if frame.Bounds() != expected[i] || opt.Disposal[i] != disposals[i] {
+			t.Fatal(i, frame.Bounds(), opt.Disposal[i])
+		}
+	}
+
+	// Frame 1 only draws the pixels that changed in its rectangle:
+	if opt.Image[1].ColorIndexAt(4, 4) == opt.Image[1].ColorIndexAt(5, 5) {
+		t.Fatal()
+	}
+	if opt.Image[1].ColorIndexAt(7, 7) == uint8(len(opt.Image[1].Palette)-1) {
+		t.Fatal()
+	}
+
+	// Whatever was left out, every frame should look the same as it does when
+	// emitted in full:
+	exp, result := compositeGIF(full), compositeGIF(opt)
+	for i := range exp {
+		if !reflect.DeepEqual(exp[i].Pix, result[i].Pix) {
+			t.Fatal(i)
+		}
+	}
+}
+
+func TestToGIFConfigColors(t *testing.T) {
+	q := New()
+	q.Colors = 8
+
+	g, err := q.ToGIF(genGIFFrames(2, 16, 16), []int{5, 5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range g.Image {
+		if len(frame.Palette) != 8 {
+			t.Fatal(i, len(frame.Palette))
+		}
+	}
+}
+
+func TestToGIFErrors(t *testing.T) {
+	frames := genGIFFrames(2, 16, 16)
+	q := New()
+
+	if _, err := q.ToGIF(nil, nil, nil); err == nil {
+		t.Fatal()
+	}
+	if _, err := q.ToGIF(frames, []int{1}, nil); err == nil {
+		t.Fatal()
+	}
+	if _, err := q.ToGIF(frames, []int{1, 1}, &GIFOptions{Colors: 257}); err == nil {
+		t.Fatal()
+	}
+
+	frames[1] = image.NewRGBA(image.Rect(0, 0, 8, 8))
+	if _, err := q.ToGIF(frames, []int{1, 1}, nil); err == nil {
+		t.Fatal()
+	}
+}
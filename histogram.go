@@ -0,0 +1,260 @@
+package wu2quant
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image/color"
+	"math"
+)
+
+// Merge adds the pixels counted by other to h, as if every image passed to
+// other's Add had also been passed to h's.
+func (h *Histogram) Merge(other *Histogram) {
+	if other.sq == nil {
+		return
+	}
+	if h.sq == nil {
+		h.sq = new([3]momentFloat64)
+	}
+
+	for r := 1; r <= HistogramCells; r++ {
+		for g := 1; g <= HistogramCells; g++ {
+			for b := 1; b <= HistogramCells; b++ {
+				if other.wt[r][g][b] == 0 {
+					continue
+				}
+				h.wt[r][g][b] += other.wt[r][g][b]
+				h.mr[r][g][b] += other.mr[r][g][b]
+				h.mg[r][g][b] += other.mg[r][g][b]
+				h.mb[r][g][b] += other.mb[r][g][b]
+				for c := range h.sq {
+					h.sq[c][r][g][b] += other.sq[c][r][g][b]
+				}
+			}
+		}
+	}
+	h.pixels += other.pixels
+}
+
+// The binary format of a Histogram is:
+//
+//	magic   "WU2H"
+//	version uvarint, currently 1
+//	pixels  uvarint
+//	cells   uvarint, the number of occupied cells that follow
+//
+// followed by each occupied cell in ascending order of r<<10 | g<<5 | b:
+//
+//	skip    uvarint, the number of empty cells since the previous one
+//	count   uvarint
+//	sums    3 * uvarint, the sums of the R, G and B values
+//	squares 3 * float64, little endian, the sums of the squares of the values
+const (
+	histogramMagic   = "WU2H"
+	histogramVersion = 1
+)
+
+// MarshalBinary encodes h in a compact, versioned binary format that only
+// includes the occupied cells. It implements encoding.BinaryMarshaler.
+func (h *Histogram) MarshalBinary() ([]byte, error) {
+	var (
+		out  = append([]byte(nil), histogramMagic...)
+		tmp  [binary.MaxVarintLen64]byte
+		cell uint64
+		next uint64
+	)
+
+	putUvarint := func(v uint64) {
+		out = append(out, tmp[:binary.PutUvarint(tmp[:], v)]...)
+	}
+
+	putUvarint(histogramVersion)
+	putUvarint(uint64(h.pixels))
+	putUvarint(uint64(h.Occupied()))
+
+	for r := 1; r <= HistogramCells; r++ {
+		for g := 1; g <= HistogramCells; g++ {
+			for b := 1; b <= HistogramCells; b++ {
+				cell = uint64(r-1)<<10 | uint64(g-1)<<5 | uint64(b-1)
+				if h.wt[r][g][b] == 0 {
+					continue
+				}
+
+				putUvarint(cell - next)
+				next = cell + 1
+
+				putUvarint(uint64(h.wt[r][g][b]))
+				putUvarint(uint64(h.mr[r][g][b]))
+				putUvarint(uint64(h.mg[r][g][b]))
+				putUvarint(uint64(h.mb[r][g][b]))
+				for c := range h.sq {
+					binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(h.sq[c][r][g][b]))
+					out = append(out, tmp[:8]...)
+				}
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// UnmarshalBinary replaces h with a histogram encoded by MarshalBinary. It
+// implements encoding.BinaryUnmarshaler. If data is not a valid histogram, h is
+// left unchanged.
+func (h *Histogram) UnmarshalBinary(data []byte) error {
+	if len(data) < len(histogramMagic) || string(data[:len(histogramMagic)]) != histogramMagic {
+		return fmt.Errorf("wu2quant: data is not a histogram")
+	}
+
+	d := binaryDecoder{data: data[len(histogramMagic):]}
+	if version := d.uvarint(); d.err == nil && version != histogramVersion {
+		return fmt.Errorf("wu2quant: unsupported histogram version %d", version)
+	}
+
+	var (
+		out    = &Histogram{sq: new([3]momentFloat64)}
+		pixels = d.uvarint()
+		cells  = d.uvarint()
+		next   uint64
+		total  uint64
+	)
+	out.pixels = int64(pixels)
+
+	for i := uint64(0); i < cells && d.err == nil; i++ {
+		cell := next + d.uvarint()
+		if cell >= HistogramCells*HistogramCells*HistogramCells {
+			return fmt.Errorf("wu2quant: histogram cell %d out of range", cell)
+		}
+		next = cell + 1
+
+		r, g, b := int(cell>>10)+1, int(cell>>5&31)+1, int(cell&31)+1
+		count := d.uvarint()
+		sr, sg, sb := d.uvarint(), d.uvarint(), d.uvarint()
+		if count == 0 || count > pixels || count > math.MaxInt64/0xff || sr > 0xff*count || sg > 0xff*count || sb > 0xff*count {
+			return fmt.Errorf("wu2quant: histogram cell %d is corrupt", cell)
+		}
+		total += count
+
+		out.wt[r][g][b] = int64(count)
+		out.mr[r][g][b] = int64(sr)
+		out.mg[r][g][b] = int64(sg)
+		out.mb[r][g][b] = int64(sb)
+		for c := range out.sq {
+			sq := d.float64()
+			if math.IsNaN(sq) || math.IsInf(sq, 0) || sq < 0 {
+				return fmt.Errorf("wu2quant: histogram cell %d is corrupt", cell)
+			}
+			out.sq[c][r][g][b] = sq
+		}
+	}
+
+	switch {
+	case d.err != nil:
+		return d.err
+	case len(d.data) != 0:
+		return fmt.Errorf("wu2quant: found %d bytes after the end of the histogram", len(d.data))
+	case total != pixels:
+		return fmt.Errorf("wu2quant: histogram cells contain %d pixels; expected %d", total, pixels)
+	}
+
+	*h = *out
+	return nil
+}
+
+// binaryDecoder reads the values of the Histogram and Mapper binary formats,
+// recording the first error encountered.
+type binaryDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = fmt.Errorf("wu2quant: data is truncated or corrupt")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *binaryDecoder) float64() float64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.data) < 8 {
+		d.err = fmt.Errorf("wu2quant: data is truncated or corrupt")
+		return 0
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(d.data))
+	d.data = d.data[8:]
+	return v
+}
+
+// HistogramPalette builds a palette of up to paletteColors from the pixels
+// counted by h, as ToPaletted would for a single image containing all of them.
+// If paletteColors is 0, the Quantizer's Colors is used.
+// Settings that select or map the pixels of an image, such as Exact, Sample,
+// Transparent and the masks, do not apply. Histograms record colours in sRGB,
+// so ColorSpaceLinear is not supported.
+//
+// The Quantizer keeps the mapping from colours to palette entries until it is
+// next used.
+func (q *Quantizer) HistogramPalette(paletteColors int, h *Histogram) (color.Palette, error) {
+	var cols quantizedColors
+	if err := q.histogramColors(&cols, q.paletteColors(paletteColors), h); err != nil {
+		return nil, err
+	}
+	return cols.appendTo(make(color.Palette, 0, cols.paletteSize)), nil
+}
+
+// histogramColors is quantize for a Histogram.
+func (q *Quantizer) histogramColors(into *quantizedColors, paletteColors int, h *Histogram) error {
+	if err := q.validate(paletteColors); err != nil {
+		return fmt.Errorf("wu2quant: %w", err)
+	}
+	if q.ColorSpace != ColorSpaceSRGB {
+		return fmt.Errorf("wu2quant: histograms can only be quantized in the sRGB color space")
+	}
+	if err := q.requireWu("histogram quantization"); err != nil {
+		return fmt.Errorf("wu2quant: %w", err)
+	}
+
+	q.reset()
+	q.hist.load(h)
+	q.palette(into, paletteColors)
+	return nil
+}
+
+// load copies the counts and sums of h into hist, which must be empty, and
+// weights its sums of squares by hist's channel weights.
+func (hist *histogram3D) load(h *Histogram) {
+	if h.sq == nil {
+		return
+	}
+
+	hist.wt, hist.mr, hist.mg, hist.mb = h.wt, h.mr, h.mg, h.mb
+
+	var (
+		w          = hist.weights
+		wr, wg, wb = float64(w.R), float64(w.G), float64(w.B)
+	)
+	for r := 1; r <= HistogramCells; r++ {
+		for g := 1; g <= HistogramCells; g++ {
+			for b := 1; b <= HistogramCells; b++ {
+				if hist.wt[r][g][b] == 0 {
+					continue
+				}
+				m2 := wr*h.sq[0][r][g][b] + wg*h.sq[1][r][g][b] + wb*h.sq[2][r][g][b]
+				if hist.m2p != nil {
+					hist.m2p[r][g][b] = m2
+				} else {
+					hist.m2[r][g][b] = float32(m2)
+				}
+			}
+		}
+	}
+}
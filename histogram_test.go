@@ -0,0 +1,160 @@
+package wu2quant
+
+import (
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestHistogramMerge(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	a, b := genRGBAWithRandomRGBPerPixel(rng, 30, 20), genRGBAWithRandomRGBPerPixel(rng, 10, 40)
+
+	exp := NewHistogram()
+	exp.Add(a)
+	exp.Add(b)
+
+	ha, hb := NewHistogram(), NewHistogram()
+	ha.Add(a)
+	hb.Add(b)
+	ha.Merge(hb)
+	ha.Merge(NewHistogram())
+
+	if !reflect.DeepEqual(exp, ha) {
+		t.Fatal()
+	}
+}
+
+func TestHistogramMarshal(t *testing.T) {
+	h := NewHistogram()
+	h.Add(genRGBAWithRandomRGBPerPixel(rand.New(rand.NewSource(0)), 50, 50))
+
+	data, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out Histogram
+	if err := out.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h, &out) {
+		t.Fatal()
+	}
+
+	// Empty histograms survive the round trip too:
+	data, err = NewHistogram().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := out.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if out.Pixels() != 0 || out.Occupied() != 0 {
+		t.Fatal(out.Pixels(), out.Occupied())
+	}
+}
+
+func TestHistogramUnmarshalInvalid(t *testing.T) {
+	h := NewHistogram()
+	h.Add(genRGBAWithRandomRGBPerPixel(rand.New(rand.NewSource(0)), 4, 4))
+	data, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withByte := func(i int, v byte) []byte {
+		out := append([]byte(nil), data...)
+		out[i] = v
+		return out
+	}
+
+	// The last 8 bytes are the sum of the squares of the blue channel of the
+	// last cell:
+	withSquares := func(v float64) []byte {
+		out := append([]byte(nil), data...)
+		binary.LittleEndian.PutUint64(out[len(out)-8:], math.Float64bits(v))
+		return out
+	}
+
+	for i, bad := range [][]byte{
+		nil,
+		[]byte("WU2"),
+		withByte(0, 'X'),
+		withByte(4, 2),                        // version
+		withByte(5, data[5]+1),                // pixels
+		data[:len(data)-1],                    // truncated
+		append(data[:len(data):len(data)], 0), // trailing data
+		withSquares(math.NaN()),
+		withSquares(math.Inf(1)),
+		withSquares(-1),
+	} {
+		var out Histogram
+		if err := out.UnmarshalBinary(bad); err == nil {
+			t.Fatal(i)
+		}
+		if out.Pixels() != 0 {
+			t.Fatal(i)
+		}
+	}
+}
+
+func TestHistogramPalette(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	a, b := genRGBAWithRandomRGBPerPixel(rng, 40, 30), genRGBAWithRandomRGBPerPixel(rng, 40, 20)
+
+	// The palette of the merged histograms is the palette of a single image
+	// containing both:
+	both := image.NewRGBA(image.Rect(0, 0, 40, 50))
+	draw.Draw(both, a.Bounds(), a, image.Point{}, draw.Src)
+	draw.Draw(both, b.Bounds().Add(image.Pt(0, 30)), b, image.Point{}, draw.Src)
+
+	ha, hb := NewHistogram(), NewHistogram()
+	ha.Add(a)
+	hb.Add(b)
+	data, err := hb.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Histogram
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	ha.Merge(&decoded)
+
+	for _, c := range []Config{
+		{Precise: true},
+		{Precise: true, Split: SplitMedian},
+		{Precise: true, Depth: DepthRGB565},
+	} {
+		q := &Quantizer{Config: c}
+		exp, err := q.ToPaletted(16, both, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pal, err := q.HistogramPalette(16, ha)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(exp.Palette, pal) {
+			t.Fatal(c, exp.Palette, pal)
+		}
+	}
+
+	// Weights are applied when the palette is built:
+	q := New()
+	q.Weights = WeightsRec709
+	if pal, err := q.HistogramPalette(16, ha); err != nil || len(pal) != 16 {
+		t.Fatal(err, len(pal))
+	}
+
+	q = New()
+	q.ColorSpace = ColorSpaceLinear
+	if _, err := q.HistogramPalette(16, ha); err == nil {
+		t.Fatal()
+	}
+}
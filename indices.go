@@ -0,0 +1,142 @@
+package wu2quant
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// RGBAToIndices is like RGBAToPaletted, but writes the result into buffers owned
+// by the caller rather than allocating an *image.Paletted. The palette is
+// appended to pal[:0] and returned, and the palette index of each pixel of m is
+// written to indices in row order, with no gap between rows. indices must have
+// room for every pixel of m.
+//
+// Pixels excluded by MapMask are left unchanged in indices.
+//
+// If buf is reused and Dither is not set, RGBAToIndices does not allocate once
+// pal has enough capacity for the palette.
+func (q *Quantizer) RGBAToIndices(paletteColors int, m *image.RGBA, pal []color.RGBA, indices []uint8, buf *Buffer) ([]color.RGBA, error) {
+	var (
+		cols   quantizedColors
+		bounds = m.Bounds()
+		pixels = bounds.Dx() * bounds.Dy()
+	)
+
+	if len(indices) < pixels {
+		return nil, fmt.Errorf("wu2quant: index buffer has %d elements for %d pixels", len(indices), pixels)
+	}
+
+	buf = ensureBuffer(buf, pixels)
+	if err := q.quantize(&cols, m, q.paletteColors(paletteColors), buf.qadd); err != nil {
+		return nil, err
+	}
+
+	q.mapRGBA(buf.paletted(bounds, indices, &cols, q.Dither), m, &cols, buf.qadd, alphaMask(q.MapMask, bounds))
+	buf.out.Pix = nil // don't keep the caller's buffer alive
+
+	return cols.appendRGBATo(pal[:0]), nil
+}
+
+// RGBAToIndices16 is like RGBAToIndices, but writes the palette index of each
+// pixel as a uint16, which allows palettes of up to 4096 colours. Exact only
+// applies to palettes of up to 256 colours, as does Dither.
+func (q *Quantizer) RGBAToIndices16(paletteColors int, m *image.RGBA, pal []color.RGBA, indices []uint16, buf *Buffer) ([]color.RGBA, error) {
+	var (
+		cols   quantizedColors
+		bounds = m.Bounds()
+		pixels = bounds.Dx() * bounds.Dy()
+		mask   = alphaMask(q.MapMask, bounds)
+	)
+
+	if len(indices) < pixels {
+		return nil, fmt.Errorf("wu2quant: index buffer has %d elements for %d pixels", len(indices), pixels)
+	}
+
+	buf = ensureBuffer(buf, pixels)
+	if err := q.quantizeUpTo(&cols, m, q.paletteColors(paletteColors), maxWideColors, buf.qadd); err != nil {
+		return nil, err
+	}
+
+	if !q.Dither {
+		q.mapIndices16(indices[:pixels], m, &cols, buf.qadd, mask)
+		return cols.appendRGBATo(pal[:0]), nil
+	}
+
+	// The Drawer writes 8-bit indices, so dithered pixels are mapped into a
+	// scratch buffer and widened:
+	if cap(buf.narrow) < pixels {
+		buf.narrow = make([]uint8, pixels)
+	}
+	narrow := buf.narrow[:pixels]
+	q.mapRGBA(buf.paletted(bounds, narrow, &cols, true), m, &cols, buf.qadd, mask)
+	for i, idx := range narrow {
+		indices[i] = uint16(idx)
+	}
+
+	return cols.appendRGBATo(pal[:0]), nil
+}
+
+// mapIndices16 is like mapRGBA, but writes uint16 indices to dst in row order,
+// so palettes may have more than maxColors entries. It does not dither.
+func (q *Quantizer) mapIndices16(dst []uint16, m *image.RGBA, cols *quantizedColors, qadd []paletteIndex, mask *image.Alpha) {
+	var (
+		bounds      = m.Bounds()
+		transparent = uint16(cols.paletteSize)
+		levels      *levelTable
+		i           int
+	)
+
+	if cols.mapping == mapLevels {
+		levels = cols.levels.table()
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		pix := m.Pix[m.PixOffset(bounds.Min.X, y):][:bounds.Dx()*4]
+		for x := 0; x < len(pix); x, i = x+4, i+1 {
+			if maskedOut(mask, bounds.Min.X+x/4, y) {
+				continue
+			}
+
+			r, g, b := pix[x], pix[x+1], pix[x+2]
+			switch {
+			case cols.transparent && pix[x+3] < alphaThreshold:
+				dst[i] = transparent
+			case levels != nil:
+				dst[i] = uint16(levels.index(r, g, b))
+			case cols.mapping == mapExact:
+				dst[i] = uint16(q.exact.index(uint32(r)<<16 | uint32(g)<<8 | uint32(b)))
+			case cols.mapping == mapPixels:
+				dst[i] = uint16(q.tag[cellIndex(r, g, b)])
+			default:
+				dst[i] = uint16(q.tag[qadd[i]])
+			}
+		}
+	}
+}
+
+// paletted returns an *image.Paletted with the given bounds that uses pix as its
+// pixels, reusing the header held by b. If withPalette is set, the colours in
+// cols are also copied into its palette; otherwise the palette is empty, which
+// is enough for the mapping functions that only write indices.
+func (b *Buffer) paletted(bounds image.Rectangle, pix []uint8, cols *quantizedColors, withPalette bool) *image.Paletted {
+	b.out.Pix = pix[:bounds.Dx()*bounds.Dy()]
+	b.out.Stride = bounds.Dx()
+	b.out.Rect = bounds
+	b.out.Palette = b.out.Palette[:0]
+	if withPalette {
+		b.out.Palette = cols.appendTo(b.out.Palette)
+	}
+	return &b.out
+}
+
+// appendRGBATo is like appendTo, for a slice of color.RGBA.
+func (cols *quantizedColors) appendRGBATo(p []color.RGBA) []color.RGBA {
+	for i := paletteIndex(0); i < cols.paletteSize; i++ {
+		p = append(p, color.RGBA{R: cols.rLut[i], G: cols.gLut[i], B: cols.bLut[i], A: 0xff})
+	}
+	if cols.transparent {
+		p = append(p, color.RGBA{})
+	}
+	return p
+}
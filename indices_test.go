@@ -0,0 +1,161 @@
+package wu2quant
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+func TestRGBAToIndices(t *testing.T) {
+	img := genRGBAWithRandomRGBPerPixel(rand.New(rand.NewSource(0)), 50, 40)
+	sub := img.SubImage(image.Rect(3, 2, 47, 39)).(*image.RGBA)
+
+	for _, dither := range []bool{false, true} {
+		q := New()
+		q.Dither = dither
+		exp, err := q.RGBAToPaletted(16, sub, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			buf       Buffer
+			pixels    = sub.Bounds().Dx() * sub.Bounds().Dy()
+			indices   = make([]uint8, pixels)
+			indices16 = make([]uint16, pixels)
+		)
+		pal, err := q.RGBAToIndices(16, sub, make([]color.RGBA, 3), indices, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pal16, err := q.RGBAToIndices16(16, sub, nil, indices16, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(pal) != len(exp.Palette) || len(pal16) != len(exp.Palette) {
+			t.Fatal(dither, len(pal), len(pal16), len(exp.Palette))
+		}
+		for i, c := range exp.Palette {
+			if pal[i] != c || pal16[i] != c {
+				t.Fatal(dither, i, pal[i], pal16[i], c)
+			}
+		}
+
+		i := 0
+		for y := sub.Rect.Min.Y; y < sub.Rect.Max.Y; y++ {
+			for x := sub.Rect.Min.X; x < sub.Rect.Max.X; x++ {
+				if e := exp.ColorIndexAt(x, y); indices[i] != e || indices16[i] != uint16(e) {
+					t.Fatal(dither, x, y, indices[i], indices16[i], e)
+				}
+				i++
+			}
+		}
+	}
+}
+
+func TestRGBAToIndicesShortBuffer(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	if _, err := New().RGBAToIndices(4, img, nil, make([]uint8, 15), nil); err == nil {
+		t.Fatal()
+	}
+	if _, err := New().RGBAToIndices16(4, img, nil, make([]uint16, 15), nil); err == nil {
+		t.Fatal()
+	}
+}
+
+func TestRGBAToIndicesAllocs(t *testing.T) {
+	var (
+		img     = genRGBAWithRandomRGBPerPixel(rand.New(rand.NewSource(0)), 64, 64)
+		q       = New()
+		buf     Buffer
+		pal     = make([]color.RGBA, 0, 256)
+		indices = make([]uint8, 64*64)
+	)
+
+	allocs := testing.AllocsPerRun(10, func() {
+		var err error
+		pal, err = q.RGBAToIndices(256, img, pal, indices, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatal(allocs)
+	}
+}
+
+func TestRGBAToIndices16Wide(t *testing.T) {
+	var (
+		img     = genRGBAWithRandomRGBPerPixel(rand.New(rand.NewSource(0)), 128, 128)
+		indices = make([]uint16, 128*128)
+		mse     = map[int]float64{}
+	)
+
+	for _, colors := range []int{256, 1024, 4096} {
+		q := New()
+		pal, err := q.RGBAToIndices16(colors, img, nil, indices, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pal) > colors || (colors > 256 && len(pal) <= 256) {
+			t.Fatal(colors, len(pal))
+		}
+
+		var sum float64
+		for i, idx := range indices {
+			if int(idx) >= len(pal) {
+				t.Fatal(colors, i, idx)
+			}
+			c, p := img.Pix[i*4:], pal[idx]
+			dr, dg, db := float64(c[0])-float64(p.R), float64(c[1])-float64(p.G), float64(c[2])-float64(p.B)
+			sum += dr*dr + dg*dg + db*db
+		}
+		mse[colors] = sum / float64(len(indices))
+	}
+
+	if !(mse[4096] < mse[1024] && mse[1024] < mse[256]) {
+		t.Fatal(mse)
+	}
+}
+
+func TestRGBAToIndices16WideTransparent(t *testing.T) {
+	img := genRGBAWithRandomRGBPerPixel(rand.New(rand.NewSource(0)), 64, 64)
+	for i := 3; i < 64*4; i += 4 {
+		img.Pix[i] = 0
+	}
+
+	q := New()
+	q.Transparent = true
+	indices := make([]uint16, 64*64)
+	pal, err := q.RGBAToIndices16(1000, img, nil, indices, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pal) != 1000 || pal[999] != (color.RGBA{}) {
+		t.Fatal(len(pal), pal[len(pal)-1])
+	}
+	for i, idx := range indices {
+		if (i < 64) != (idx == 999) {
+			t.Fatal(i, idx)
+		}
+	}
+}
+
+func TestRGBAToIndices16WideInvalid(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+
+	if _, err := New().RGBAToIndices16(4097, img, nil, make([]uint16, 16), nil); err == nil {
+		t.Fatal()
+	}
+	if _, err := New().ToPaletted(257, img, nil); err == nil {
+		t.Fatal()
+	}
+
+	q := New()
+	q.Dither = true
+	if _, err := q.RGBAToIndices16(257, img, nil, make([]uint16, 16), nil); err == nil {
+		t.Fatal()
+	}
+}
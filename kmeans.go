@@ -0,0 +1,180 @@
+package wu2quant
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+)
+
+// KMeans quantizes images by k-means clustering of their colours, starting from
+// centres chosen by k-means++. The occupied cells of the histogram Wu's
+// algorithm uses are clustered, weighted by their number of pixels, rather than
+// every pixel, which keeps each pass to at most 32768 colours.
+//
+// KMeans implements PalettedQuantizer, so it can be compared with Quantizer. It
+// is not safe for concurrent use.
+type KMeans struct {
+	// Iterations is the largest number of passes that move each centre to the
+	// mean of its cluster. Clustering stops early if no colour changes cluster.
+	// Defaults to 16.
+	Iterations int
+
+	// Seed seeds the random choice of the initial centres, so that the same
+	// image always produces the same palette.
+	Seed int64
+
+	pipeline
+
+	dist    []float64
+	cluster []int
+}
+
+const kMeansDefaultIterations = 16
+
+func NewKMeans() *KMeans {
+	return &KMeans{}
+}
+
+// Quantize implements image/draw.Quantizer. It appends up to cap(p) - len(p)
+// colors to p and returns the updated palette.
+func (km *KMeans) Quantize(p color.Palette, m image.Image) color.Palette {
+	if err := km.validate(); err != nil {
+		panic(err)
+	}
+	return km.quantize(km.build, p, m)
+}
+
+// ToPaletted returns a paletted version of m reduced to paletteColors.
+//
+// If m is not an *image.RGBA, it will be converted to one before quantization.
+// Depending on the image type, this may trigger very slow code paths.
+func (km *KMeans) ToPaletted(paletteColors int, m image.Image, buf *Buffer) (*image.Paletted, error) {
+	if err := km.validate(); err != nil {
+		return nil, fmt.Errorf("wu2quant: %w", err)
+	}
+	return km.toPaletted(km.build, paletteColors, m, buf)
+}
+
+func (km *KMeans) validate() error {
+	if km.Iterations < 0 {
+		return fmt.Errorf("iterations must not be negative; found %d", km.Iterations)
+	}
+	return nil
+}
+
+func (km *KMeans) build(_ *image.RGBA, colors []weightedColor, paletteColors int) []color.RGBA {
+	centres := km.seed(colors, paletteColors)
+
+	iterations := km.Iterations
+	if iterations == 0 {
+		iterations = kMeansDefaultIterations
+	}
+
+	km.cluster = append(km.cluster[:0], make([]int, len(colors))...)
+	for i := range km.cluster {
+		km.cluster[i] = -1
+	}
+
+	sums := make([][4]float64, len(centres))
+	for it := 0; it < iterations; it++ {
+		changed := false
+		for i := range sums {
+			sums[i] = [4]float64{}
+		}
+
+		for i := range colors {
+			c := &colors[i]
+			best, bestDist := 0, math.MaxFloat64
+			for j, centre := range centres {
+				if d := colorDist(c, centre); d < bestDist {
+					best, bestDist = j, d
+				}
+			}
+			if km.cluster[i] != best {
+				km.cluster[i], changed = best, true
+			}
+
+			n := float64(c.n)
+			sums[best][0] += c.r * n
+			sums[best][1] += c.g * n
+			sums[best][2] += c.b * n
+			sums[best][3] += n
+		}
+
+		if !changed {
+			break
+		}
+		for j, s := range sums {
+			// Centres that lose all their colours stay where they are:
+			if s[3] > 0 {
+				centres[j] = [3]float64{s[0] / s[3], s[1] / s[3], s[2] / s[3]}
+			}
+		}
+	}
+
+	out := make([]color.RGBA, len(centres))
+	for i, c := range centres {
+		out[i] = color.RGBA{R: round8(c[0]), G: round8(c[1]), B: round8(c[2]), A: 0xff}
+	}
+	return out
+}
+
+// seed chooses up to k initial centres from colors with k-means++: the first is
+// chosen with probability proportional to its number of pixels, and each after
+// that with probability proportional to its number of pixels times its squared
+// distance from the nearest centre already chosen. Fewer than k centres are
+// returned if colors has fewer than k distinct colours.
+func (km *KMeans) seed(colors []weightedColor, k int) [][3]float64 {
+	var (
+		rng     = rand.New(rand.NewSource(km.Seed))
+		centres = make([][3]float64, 0, k)
+	)
+
+	km.dist = append(km.dist[:0], make([]float64, len(colors))...)
+	for i := range km.dist {
+		km.dist[i] = 1
+	}
+
+	for len(centres) < k {
+		var total float64
+		for i := range colors {
+			total += float64(colors[i].n) * km.dist[i]
+		}
+		if total == 0 {
+			break
+		}
+
+		var (
+			target = rng.Float64() * total
+			chosen = len(colors) - 1
+		)
+		for i := range colors {
+			target -= float64(colors[i].n) * km.dist[i]
+			if target < 0 {
+				chosen = i
+				break
+			}
+		}
+
+		c := &colors[chosen]
+		centre := [3]float64{c.r, c.g, c.b}
+		centres = append(centres, centre)
+
+		for i := range colors {
+			d := colorDist(&colors[i], centre)
+			if len(centres) == 1 || d < km.dist[i] {
+				km.dist[i] = d
+			}
+		}
+	}
+
+	return centres
+}
+
+// colorDist returns the squared distance between c and centre.
+func colorDist(c *weightedColor, centre [3]float64) float64 {
+	dr, dg, db := c.r-centre[0], c.g-centre[1], c.b-centre[2]
+	return dr*dr + dg*dg + db*db
+}
@@ -0,0 +1,285 @@
+package wu2quant
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// Mapper maps images to a fixed palette using the table of histogram cells that
+// Wu's algorithm labels while building the palette. Once built, a Mapper can
+// index any number of images, such as the frames of a video or the tiles of a
+// map, in a single pass over their pixels without building a histogram, and can
+// be stored with MarshalBinary and loaded again later.
+//
+// Every colour in a cell of 8x8x8 values maps to the same palette entry, so an
+// image whose colours were all in the palette is not necessarily mapped
+// exactly, as it would be by Exact.
+//
+// A Mapper is not modified by mapping images, so it is safe for concurrent use.
+type Mapper struct {
+	palette color.Palette
+
+	// transparent is the index of the entry reserved by Config.Transparent, or
+	// -1 if there isn't one.
+	transparent int
+
+	tag tags
+}
+
+// Mapper quantizes m to paletteColors, as ToPaletted would, and returns a Mapper
+// for the palette rather than mapping m. If paletteColors is 0, the Quantizer's
+// Colors is used.
+//
+// If m is not an *image.RGBA, it will be converted to one before quantization.
+// Depending on the image type, this may trigger very slow code paths.
+func (q *Quantizer) Mapper(paletteColors int, m image.Image) (*Mapper, error) {
+	var cols quantizedColors
+	if err := q.quantize(&cols, convertToRGBA(m), q.paletteColors(paletteColors), nil); err != nil {
+		return nil, fmt.Errorf("wu2quant: %w", err)
+	}
+	return q.newMapper(&cols), nil
+}
+
+// HistogramMapper is like HistogramPalette, but returns a Mapper for the palette.
+func (q *Quantizer) HistogramMapper(paletteColors int, h *Histogram) (*Mapper, error) {
+	var cols quantizedColors
+	if err := q.histogramColors(&cols, q.paletteColors(paletteColors), h); err != nil {
+		return nil, err
+	}
+	return q.newMapper(&cols), nil
+}
+
+// newMapper returns a Mapper for cols, using the labels in q.tag from the most
+// recent call to palette. Cells that palette did not label, which are the cells
+// left out of a compacted histogram and every cell if the colours are exact or
+// levels, are labelled with the colour nearest to the centre of the cell.
+func (q *Quantizer) newMapper(cols *quantizedColors) *Mapper {
+	mp := &Mapper{
+		palette:     cols.appendTo(make(color.Palette, 0, cols.paletteSize+1)),
+		transparent: -1,
+	}
+	if cols.transparent {
+		mp.transparent = int(cols.paletteSize)
+	}
+
+	var labelled [3][33]bool
+	switch {
+	case cols.mapping == mapExact, cols.mapping == mapLevels:
+	case q.hist.compacted:
+		for axis, coords := range q.hist.axes {
+			for _, c := range coords[1:] {
+				labelled[axis][c] = true
+			}
+		}
+	default:
+		for axis := range labelled {
+			for c := range labelled[axis] {
+				labelled[axis][c] = true
+			}
+		}
+	}
+
+	var (
+		w      = q.Weights.orDefault()
+		colors = make([]color.RGBA, cols.paletteSize)
+	)
+	for i := range colors {
+		colors[i] = mp.palette[i].(color.RGBA)
+	}
+
+	for r := 1; r <= 32; r++ {
+		for g := 1; g <= 32; g++ {
+			for b := 1; b <= 32; b++ {
+				cell := (r << 10) + (r << 6) + r + (g << 5) + g + b
+				if labelled[0][r] && labelled[1][g] && labelled[2][b] {
+					mp.tag[cell] = q.tag[cell]
+				} else {
+					mp.tag[cell] = nearestColor(colors, w, (r-1)<<3+4, (g-1)<<3+4, (b-1)<<3+4, false)
+				}
+			}
+		}
+	}
+
+	return mp
+}
+
+// Palette returns the Mapper's palette. It must not be modified.
+func (mp *Mapper) Palette() color.Palette {
+	return mp.palette
+}
+
+// Index returns the index of the palette entry that c is mapped to.
+func (mp *Mapper) Index(c color.Color) int {
+	rgba := color.RGBAModel.Convert(c).(color.RGBA)
+	if mp.transparent >= 0 && rgba.A < alphaThreshold {
+		return mp.transparent
+	}
+	return int(mp.tag[cellIndex(rgba.R, rgba.G, rgba.B)])
+}
+
+// ToPaletted returns a copy of m mapped to the Mapper's palette.
+func (mp *Mapper) ToPaletted(m *image.RGBA) *image.Paletted {
+	out := image.NewPaletted(m.Bounds(), append(color.Palette(nil), mp.palette...))
+	mp.mapRGBA(out, m)
+	return out
+}
+
+// IntoPaletted maps m to the Mapper's palette, writing the result into o. If
+// m.Bounds() != o.Bounds(), an error is returned. o.Palette is replaced, as it
+// is by Quantizer.IntoPaletted.
+func (mp *Mapper) IntoPaletted(m *image.RGBA, o *image.Paletted) error {
+	if m.Bounds() != o.Bounds() {
+		return fmt.Errorf("wu2quant: input image m bounds %v did not match output image bounds %v", m.Bounds(), o.Bounds())
+	}
+	o.Palette = append(o.Palette[:0], mp.palette...)
+	mp.mapRGBA(o, m)
+	return nil
+}
+
+func (mp *Mapper) mapRGBA(o *image.Paletted, m *image.RGBA) {
+	bounds := m.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		pix := m.Pix[m.PixOffset(bounds.Min.X, y):][:bounds.Dx()*4]
+		row := o.Pix[o.PixOffset(bounds.Min.X, y):][:bounds.Dx()]
+		for x := range row {
+			r, g, b, a := pix[x*4], pix[x*4+1], pix[x*4+2], pix[x*4+3]
+			if mp.transparent >= 0 && a < alphaThreshold {
+				row[x] = uint8(mp.transparent)
+			} else {
+				row[x] = uint8(mp.tag[cellIndex(r, g, b)])
+			}
+		}
+	}
+}
+
+// The binary format of a Mapper is:
+//
+//	magic       "WU2M"
+//	version     uvarint, currently 1
+//	colors      uvarint, the number of palette entries that follow
+//	palette     colors * 4 bytes of R, G, B and A
+//	transparent uvarint, the index of the transparent entry plus one, or 0
+//
+// followed by the palette index of each of the 32768 cells, in ascending order
+// of r<<10 | g<<5 | b, as runs of cells with the same index:
+//
+//	run   uvarint, the number of cells in the run
+//	index uvarint
+const (
+	mapperMagic   = "WU2M"
+	mapperVersion = 1
+)
+
+// MarshalBinary encodes the Mapper in a compact, versioned binary format. It
+// implements encoding.BinaryMarshaler.
+func (mp *Mapper) MarshalBinary() ([]byte, error) {
+	var (
+		out = append([]byte(nil), mapperMagic...)
+		tmp [binary.MaxVarintLen64]byte
+	)
+
+	putUvarint := func(v uint64) {
+		out = append(out, tmp[:binary.PutUvarint(tmp[:], v)]...)
+	}
+
+	putUvarint(mapperVersion)
+	putUvarint(uint64(len(mp.palette)))
+	for _, c := range mp.palette {
+		rgba := color.RGBAModel.Convert(c).(color.RGBA)
+		out = append(out, rgba.R, rgba.G, rgba.B, rgba.A)
+	}
+	putUvarint(uint64(mp.transparent + 1))
+
+	var (
+		run  uint64
+		last paletteIndex
+	)
+	for r := 1; r <= 32; r++ {
+		for g := 1; g <= 32; g++ {
+			for b := 1; b <= 32; b++ {
+				idx := mp.tag[(r<<10)+(r<<6)+r+(g<<5)+g+b]
+				if run > 0 && idx != last {
+					putUvarint(run)
+					putUvarint(uint64(last))
+					run = 0
+				}
+				last = idx
+				run++
+			}
+		}
+	}
+	putUvarint(run)
+	putUvarint(uint64(last))
+
+	return out, nil
+}
+
+// UnmarshalBinary replaces the Mapper with one encoded by MarshalBinary. It
+// implements encoding.BinaryUnmarshaler. If data is not a valid Mapper, mp is
+// left unchanged.
+func (mp *Mapper) UnmarshalBinary(data []byte) error {
+	if len(data) < len(mapperMagic) || string(data[:len(mapperMagic)]) != mapperMagic {
+		return fmt.Errorf("wu2quant: data is not a mapper")
+	}
+
+	d := binaryDecoder{data: data[len(mapperMagic):]}
+	if version := d.uvarint(); d.err == nil && version != mapperVersion {
+		return fmt.Errorf("wu2quant: unsupported mapper version %d", version)
+	}
+
+	colors := d.uvarint()
+	if d.err == nil && (colors == 0 || colors > uint64(maxColors)) {
+		return fmt.Errorf("wu2quant: mapper palette size must be 0 < sz <= %d; found %d", maxColors, colors)
+	}
+	if d.err == nil && uint64(len(d.data)) < colors*4 {
+		return fmt.Errorf("wu2quant: mapper data is truncated")
+	}
+
+	out := &Mapper{palette: make(color.Palette, colors)}
+	for i := range out.palette {
+		out.palette[i] = color.RGBA{d.data[0], d.data[1], d.data[2], d.data[3]}
+		d.data = d.data[4:]
+	}
+
+	transparent := d.uvarint()
+	if transparent > colors {
+		return fmt.Errorf("wu2quant: mapper transparent index %d out of range", transparent-1)
+	}
+	out.transparent = int(transparent) - 1
+
+	cells := make([]paletteIndex, 0, 32*32*32)
+	for d.err == nil && len(cells) < cap(cells) {
+		run, idx := d.uvarint(), d.uvarint()
+		if d.err != nil {
+			break
+		}
+		if run == 0 || run > uint64(cap(cells)-len(cells)) || idx >= colors {
+			return fmt.Errorf("wu2quant: mapper cell table is corrupt")
+		}
+		for ; run > 0; run-- {
+			cells = append(cells, paletteIndex(idx))
+		}
+	}
+
+	switch {
+	case d.err != nil:
+		return d.err
+	case len(d.data) != 0:
+		return fmt.Errorf("wu2quant: found %d bytes after the end of the mapper", len(d.data))
+	}
+
+	i := 0
+	for r := 1; r <= 32; r++ {
+		for g := 1; g <= 32; g++ {
+			for b := 1; b <= 32; b++ {
+				out.tag[(r<<10)+(r<<6)+r+(g<<5)+g+b] = cells[i]
+				i++
+			}
+		}
+	}
+
+	*mp = *out
+	return nil
+}
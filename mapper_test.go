@@ -0,0 +1,182 @@
+package wu2quant
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestMapperMatchesToPaletted(t *testing.T) {
+	var (
+		rng   = rand.New(rand.NewSource(0))
+		large = genRGBAWithRandomRGBPerPixel(rng, 200, 200)
+		small = genRGBAWithRandomColorsFromPalette(rng, genRandomRGBAPalette(rng, 40), 32, 32)
+	)
+
+	for _, img := range []*image.RGBA{large, small} {
+		for _, c := range []Config{{}, {Mapping: MapNearest}, {Depth: DepthRGB565}} {
+			q := &Quantizer{Config: c}
+			exp, err := q.ToPaletted(16, img, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mp, err := q.Mapper(16, img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(exp.Palette, mp.Palette()) {
+				t.Fatal(c, exp.Palette, mp.Palette())
+			}
+			if result := mp.ToPaletted(img); !reflect.DeepEqual(exp.Pix, result.Pix) {
+				t.Fatal(c)
+			}
+		}
+	}
+}
+
+func TestMapperUnlabelledCells(t *testing.T) {
+	var (
+		red  = color.RGBA{0xff, 0x00, 0x00, 0xff}
+		blue = color.RGBA{0x00, 0x00, 0xff, 0xff}
+		img  = genHalves(4, 4, red, blue)
+	)
+
+	// Exact colours and compacted histograms leave most cells unlabelled, which
+	// are mapped to the nearest colour instead:
+	for _, exact := range []bool{false, true} {
+		q := New()
+		q.Exact = exact
+		mp, err := q.Mapper(2, img)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pal := mp.Palette()
+		for _, tc := range []struct {
+			in, exp color.RGBA
+		}{
+			{red, red},
+			{blue, blue},
+			{color.RGBA{0xe0, 0x20, 0x10, 0xff}, red},
+			{color.RGBA{0x10, 0x20, 0xe0, 0xff}, blue},
+		} {
+			if c := pal[mp.Index(tc.in)]; c != tc.exp {
+				t.Fatal(exact, tc.in, c)
+			}
+		}
+	}
+}
+
+func TestMapperTransparent(t *testing.T) {
+	var (
+		red = color.RGBA{0xff, 0x00, 0x00, 0xff}
+		img = genHalves(4, 4, color.RGBA{}, red)
+	)
+
+	q := New()
+	q.Transparent = true
+	mp, err := q.Mapper(4, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mp.Palette(), color.Palette{red, color.RGBA{}}) {
+		t.Fatal(mp.Palette())
+	}
+	if mp.Index(color.RGBA{}) != 1 || mp.Index(red) != 0 {
+		t.Fatal(mp.Index(color.RGBA{}), mp.Index(red))
+	}
+}
+
+func TestMapperIntoPaletted(t *testing.T) {
+	img := genRGBAWithRandomRGBPerPixel(rand.New(rand.NewSource(0)), 20, 20)
+	mp, err := New().Mapper(8, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := img.SubImage(image.Rect(2, 3, 12, 13)).(*image.RGBA)
+	o := image.NewPaletted(sub.Bounds(), nil)
+	if err := mp.IntoPaletted(sub, o); err != nil {
+		t.Fatal(err)
+	}
+	for y := 3; y < 13; y++ {
+		for x := 2; x < 12; x++ {
+			if o.ColorIndexAt(x, y) != uint8(mp.Index(img.At(x, y))) {
+				t.Fatal(x, y)
+			}
+		}
+	}
+
+	if err := mp.IntoPaletted(img, o); err == nil {
+		t.Fatal()
+	}
+}
+
+func TestHistogramMapper(t *testing.T) {
+	img := genRGBAWithRandomRGBPerPixel(rand.New(rand.NewSource(0)), 200, 200)
+	h := NewHistogram()
+	h.Add(img)
+
+	q := New()
+	q.Precise = true
+	exp, err := q.ToPaletted(16, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp, err := q.HistogramMapper(16, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := mp.ToPaletted(img); !reflect.DeepEqual(exp, result) {
+		t.Fatal()
+	}
+}
+
+func TestMapperMarshal(t *testing.T) {
+	img := genHalves(4, 4, color.RGBA{}, color.RGBA{0x10, 0x20, 0x30, 0xff})
+	img.Pix[0] = 0x80
+
+	q := New()
+	q.Transparent = true
+	mp, err := q.Mapper(4, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := mp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Mapper
+	if err := out.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mp, &out) {
+		t.Fatal()
+	}
+
+	withByte := func(i int, v byte) []byte {
+		out := append([]byte(nil), data...)
+		out[i] = v
+		return out
+	}
+	for i, bad := range [][]byte{
+		nil,
+		[]byte("WU2H"),
+		withByte(4, 2),                        // version
+		withByte(5, 0),                        // colors
+		data[:len(data)-1],                    // truncated
+		append(data[:len(data):len(data)], 0), // trailing data
+	} {
+		var out Mapper
+		if err := out.UnmarshalBinary(bad); err == nil {
+			t.Fatal(i)
+		}
+		if out.Palette() != nil {
+			t.Fatal(i)
+		}
+	}
+}
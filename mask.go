@@ -0,0 +1,97 @@
+package wu2quant
+
+import (
+	"image"
+)
+
+// alphaThreshold is the alpha value below which a pixel is treated as
+// transparent by ToGIF and by Config.Transparent.
+const alphaThreshold = 0x80
+
+// alphaMask returns mask as an *image.Alpha containing every point in r, or nil
+// if mask is nil. Points in r outside mask's bounds are masked out, as they are
+// by draw.DrawMask.
+func alphaMask(mask image.Image, r image.Rectangle) *image.Alpha {
+	if mask == nil {
+		return nil
+	}
+	if a, ok := mask.(*image.Alpha); ok && r.In(a.Bounds()) {
+		return a
+	}
+
+	out := image.NewAlpha(r)
+	in := r.Intersect(mask.Bounds())
+	for y := in.Min.Y; y < in.Max.Y; y++ {
+		for x := in.Min.X; x < in.Max.X; x++ {
+			_, _, _, a := mask.At(x, y).RGBA()
+			out.Pix[out.PixOffset(x, y)] = uint8(a >> 8)
+		}
+	}
+	return out
+}
+
+// maskedOut reports whether the pixel at x, y is excluded by mask. If mask is
+// not nil, it must contain x, y.
+func maskedOut(mask *image.Alpha, x, y int) bool {
+	return mask != nil && mask.Pix[mask.PixOffset(x, y)] == 0
+}
+
+// buildMasked is like build, but only accumulates the pixels where mask is not
+// zero. The cell of every pixel, masked or not, is recorded in qadd so that the
+// whole image can be mapped. If mask is nil, buildMasked is the same as build.
+func (hist *histogram3D) buildMasked(img *image.RGBA, mask *image.Alpha, qadd []paletteIndex) {
+	if mask == nil {
+		hist.build(img, qadd)
+		return
+	}
+
+	var (
+		bounds = img.Bounds()
+		qidx   int
+	)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		pix := img.Pix[img.PixOffset(bounds.Min.X, y):][:bounds.Dx()*4]
+		msk := mask.Pix[mask.PixOffset(bounds.Min.X, y):][:bounds.Dx()]
+		for x, idx := 0, 0; x < len(msk); x, idx = x+1, idx+4 {
+			if msk[x] != 0 {
+				hist.add(int64(pix[idx]), int64(pix[idx+1]), int64(pix[idx+2]))
+			}
+			if qadd != nil {
+				qadd[qidx] = cellIndex(pix[idx], pix[idx+1], pix[idx+2])
+				qidx++
+			}
+		}
+	}
+}
+
+func hasTransparency(m *image.RGBA) bool {
+	bounds := m.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		idx := m.PixOffset(bounds.Min.X, y)
+		end := idx + bounds.Dx()*4
+		for ; idx < end; idx += 4 {
+			if m.Pix[idx+3] < alphaThreshold {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// opaqueMask returns a mask of the pixels in m that are not masked out by mask,
+// which may be nil, and have an alpha value of at least alphaThreshold.
+func opaqueMask(m *image.RGBA, mask *image.Alpha) *image.Alpha {
+	bounds := m.Bounds()
+	out := image.NewAlpha(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		pix := m.Pix[m.PixOffset(bounds.Min.X, y):][:bounds.Dx()*4]
+		row := out.Pix[out.PixOffset(bounds.Min.X, y):][:bounds.Dx()]
+		for x := range row {
+			if pix[x*4+3] >= alphaThreshold && !maskedOut(mask, bounds.Min.X+x, y) {
+				row[x] = 0xff
+			}
+		}
+	}
+	return out
+}
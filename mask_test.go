@@ -0,0 +1,105 @@
+package wu2quant
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func genHalves(w, h int, left, right color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < w/2 {
+				img.SetRGBA(x, y, left)
+			} else {
+				img.SetRGBA(x, y, right)
+			}
+		}
+	}
+	return img
+}
+
+func TestPaletteMask(t *testing.T) {
+	var (
+		red  = color.RGBA{0xff, 0x00, 0x00, 0xff}
+		blue = color.RGBA{0x00, 0x00, 0xff, 0xff}
+		img  = genHalves(20, 10, red, blue)
+	)
+
+	// Only the left half is inside the bounds of the first mask:
+	left := image.NewAlpha(image.Rect(0, 0, 10, 10))
+	for i := range left.Pix {
+		left.Pix[i] = 0xff
+	}
+
+	for _, mask := range []image.Image{
+		left,
+		genHalves(20, 10, color.RGBA{A: 0xff}, color.RGBA{}),
+	} {
+		for _, sampling := range []Sampling{{}, {Mode: SampleEvery, N: 3}} {
+			q := New()
+			q.PaletteMask = mask
+			q.Sample = sampling
+			q.Exact = true
+			result, err := q.ToPaletted(4, img, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Palette) != 1 || result.Palette[0] != red {
+				t.Fatal(sampling, result.Palette)
+			}
+
+			// Every pixel is still mapped:
+			for _, idx := range result.Pix {
+				if idx != 0 {
+					t.Fatal(sampling, idx)
+				}
+			}
+		}
+	}
+}
+
+func TestMapMask(t *testing.T) {
+	var (
+		red  = color.RGBA{0xff, 0x00, 0x00, 0xff}
+		blue = color.RGBA{0x00, 0x00, 0xff, 0xff}
+		img  = genHalves(20, 10, red, blue)
+		mask = image.NewAlpha(image.Rect(5, 2, 15, 8))
+	)
+	for i := range mask.Pix {
+		mask.Pix[i] = 0x01
+	}
+
+	for _, exact := range []bool{false, true} {
+		q := New()
+		q.MapMask = mask
+		q.Exact = exact
+
+		out := image.NewPaletted(img.Bounds(), nil)
+		for i := range out.Pix {
+			out.Pix[i] = 0xaa
+		}
+		if err := q.IntoPaletted(4, img, out, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// The palette is built from every pixel:
+		if len(out.Palette) != 2 {
+			t.Fatal(exact, out.Palette)
+		}
+
+		for y := 0; y < 10; y++ {
+			for x := 0; x < 20; x++ {
+				idx := out.ColorIndexAt(x, y)
+				if !image.Pt(x, y).In(mask.Rect) {
+					if idx != 0xaa {
+						t.Fatal(exact, x, y, idx)
+					}
+				} else if out.Palette[idx] != img.At(x, y) {
+					t.Fatal(exact, x, y, idx)
+				}
+			}
+		}
+	}
+}
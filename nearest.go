@@ -0,0 +1,125 @@
+package wu2quant
+
+import (
+	"image/color"
+)
+
+const (
+	// lutEmpty marks a cell in a nearestLUT that has not been looked up yet.
+	lutEmpty paletteIndex = 0xffff
+
+	// lutSearch marks a cell in a nearestLUT that contains a palette entry, and
+	// so must be searched for every colour looked up in it.
+	lutSearch paletteIndex = 0xfffe
+)
+
+// nearestLUT maps histogram cells to the nearest entry in an arbitrary palette,
+// for palettes that weren't built by Wu's algorithm (and so have no boxes to
+// mark). Cells are filled lazily the first time a colour inside them is looked
+// up, so small images don't pay for a search of all 32x32x32 cells.
+//
+// The distance is measured from the centre of the cell rather than from the
+// colour itself, which is what lets the result be cached per cell. That could map
+// a colour that is in the palette to another entry near the centre of its cell,
+// so cells that contain palette entries are searched using the colour itself,
+// as draw.FloydSteinberg does for every pixel.
+type nearestLUT struct {
+	weights     ChannelWeights
+	palette     color.Palette
+	colors      []color.RGBA
+	transparent int
+	opaque      bool
+	tag         tags
+}
+
+// reset prepares the table for looking up colours in p, measuring distance using
+// the channel weights w. If p and w are the same as in the last call to reset,
+// the existing table is kept.
+func (l *nearestLUT) reset(p color.Palette, w ChannelWeights) {
+	w = w.orDefault()
+	if l.colors != nil && w == l.weights && palettesEqual(l.palette, p) {
+		return
+	}
+
+	l.weights = w
+	l.palette = append(l.palette[:0], p...)
+	l.colors = l.colors[:0]
+	l.transparent = -1
+	l.opaque = false
+
+	for i, c := range p {
+		r, g, b, a := c.RGBA()
+		l.colors = append(l.colors, color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8), A: uint8(a >> 8)})
+		if a != 0 {
+			l.opaque = true
+		} else if l.transparent < 0 {
+			l.transparent = i
+		}
+	}
+
+	for i := range l.tag {
+		l.tag[i] = lutEmpty
+	}
+	for _, c := range l.colors {
+		if c.A != 0 || !l.opaque {
+			l.tag[cellIndex(c.R, c.G, c.B)] = lutSearch
+		}
+	}
+}
+
+// index returns the index of the palette entry nearest to the cell containing
+// r, g, b, or to r, g, b itself if the cell contains a palette entry. Fully
+// transparent palette entries are never returned unless they are the only
+// entries in the palette.
+func (l *nearestLUT) index(r, g, b uint8) paletteIndex {
+	cell := cellIndex(r, g, b)
+	idx := l.tag[cell]
+	if idx == lutSearch {
+		return l.nearest(int(r), int(g), int(b))
+	}
+	if idx == lutEmpty {
+		idx = l.nearest(int(r&^7)|4, int(g&^7)|4, int(b&^7)|4)
+		l.tag[cell] = idx
+	}
+	return idx
+}
+
+func (l *nearestLUT) nearest(r, g, b int) paletteIndex {
+	return nearestColor(l.colors, l.weights, r, g, b, l.opaque)
+}
+
+// nearestColor returns the index of the colour in colors nearest to r, g, b,
+// using the channel weights w. If skipTransparent is set, fully transparent
+// colours are never returned.
+func nearestColor(colors []color.RGBA, w ChannelWeights, r, g, b int, skipTransparent bool) paletteIndex {
+	var (
+		best     = 0
+		bestDist = float32(-1)
+	)
+	for i, c := range colors {
+		if c.A == 0 && skipTransparent {
+			continue
+		}
+		dr, dg, db := float32(r-int(c.R)), float32(g-int(c.G)), float32(b-int(c.B))
+		dist := w.R*(dr*dr) + w.G*(dg*dg) + w.B*(db*db)
+		if bestDist < 0 || dist < bestDist {
+			best, bestDist = i, dist
+			if dist == 0 {
+				break
+			}
+		}
+	}
+	return paletteIndex(best)
+}
+
+func palettesEqual(a, b color.Palette) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
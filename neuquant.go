@@ -0,0 +1,213 @@
+package wu2quant
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// NeuQuant quantizes images with Anthony Dekker's NeuQuant algorithm, which
+// trains a one-dimensional self-organising network of colours on a sample of
+// the pixels of the image. It is much slower than Wu's algorithm, but is often
+// considered to give better results on photographs.
+//
+// NeuQuant implements PalettedQuantizer, so it can be compared with Quantizer.
+// It is not safe for concurrent use.
+type NeuQuant struct {
+	// SampleFactor trains the network on one in every SampleFactor pixels, from
+	// 1, the slowest and most accurate, to 30. Images of fewer than 503 pixels
+	// are always trained on every pixel. Defaults to 10.
+	SampleFactor int
+
+	pipeline
+
+	network    [][3]float64
+	freq, bias []float64
+}
+
+const (
+	neuQuantCycles        = 100
+	neuQuantRadiusDecay   = 30
+	neuQuantBeta          = 1.0 / 1024
+	neuQuantGamma         = 1024.0
+	neuQuantMinPixels     = 503
+	neuQuantDefaultSample = 10
+)
+
+// neuQuantPrimes are the steps through the image used to sample pixels, chosen
+// so that the image is visited in an order unrelated to its rows. The first
+// that does not divide the number of pixels is used.
+var neuQuantPrimes = [...]int{499, 491, 487, 503}
+
+func NewNeuQuant() *NeuQuant {
+	return &NeuQuant{}
+}
+
+// Quantize implements image/draw.Quantizer. It appends up to cap(p) - len(p)
+// colors to p and returns the updated palette.
+func (nq *NeuQuant) Quantize(p color.Palette, m image.Image) color.Palette {
+	if err := nq.validate(); err != nil {
+		panic(err)
+	}
+	return nq.quantize(nq.build, p, m)
+}
+
+// ToPaletted returns a paletted version of m reduced to paletteColors.
+//
+// If m is not an *image.RGBA, it will be converted to one before quantization.
+// Depending on the image type, this may trigger very slow code paths.
+func (nq *NeuQuant) ToPaletted(paletteColors int, m image.Image, buf *Buffer) (*image.Paletted, error) {
+	if err := nq.validate(); err != nil {
+		return nil, fmt.Errorf("wu2quant: %w", err)
+	}
+	return nq.toPaletted(nq.build, paletteColors, m, buf)
+}
+
+func (nq *NeuQuant) validate() error {
+	if nq.SampleFactor < 0 || nq.SampleFactor > 30 {
+		return fmt.Errorf("sample factor must be between 1 and 30; found %d", nq.SampleFactor)
+	}
+	return nil
+}
+
+func (nq *NeuQuant) build(img *image.RGBA, _ []weightedColor, paletteColors int) []color.RGBA {
+	n := paletteColors
+	nq.network = append(nq.network[:0], make([][3]float64, n)...)
+	nq.freq = append(nq.freq[:0], make([]float64, n)...)
+	nq.bias = append(nq.bias[:0], make([]float64, n)...)
+
+	// The network starts as a ramp of greys:
+	for i := range nq.network {
+		v := float64(i) * 256 / float64(n)
+		nq.network[i] = [3]float64{v, v, v}
+		nq.freq[i] = 1 / float64(n)
+	}
+
+	nq.learn(img)
+
+	out := make([]color.RGBA, n)
+	for i, c := range nq.network {
+		out[i] = color.RGBA{R: round8(c[0]), G: round8(c[1]), B: round8(c[2]), A: 0xff}
+	}
+	return out
+}
+
+// learn trains the network on a sample of the pixels of img.
+func (nq *NeuQuant) learn(img *image.RGBA) {
+	var (
+		bounds = img.Bounds()
+		width  = bounds.Dx()
+		pixels = width * bounds.Dy()
+		factor = nq.SampleFactor
+	)
+	if pixels == 0 {
+		return
+	}
+	if factor == 0 {
+		factor = neuQuantDefaultSample
+	}
+	if pixels < neuQuantMinPixels {
+		factor = 1
+	}
+
+	var (
+		samples  = pixels / factor
+		delta    = samples / neuQuantCycles
+		alpha    = 1.0
+		alphaDec = float64(30 + (factor-1)/3)
+		radius   = float64(len(nq.network) >> 3)
+		rad      = neighbourhood(radius)
+		step     = neuQuantPrimes[len(neuQuantPrimes)-1]
+		pos      int
+	)
+	if delta == 0 {
+		delta = 1
+	}
+	for _, prime := range neuQuantPrimes {
+		if pixels%prime != 0 {
+			step = prime
+			break
+		}
+	}
+
+	for i := 1; i <= samples; i++ {
+		idx := img.PixOffset(bounds.Min.X+pos%width, bounds.Min.Y+pos/width)
+		c := [3]float64{float64(img.Pix[idx]), float64(img.Pix[idx+1]), float64(img.Pix[idx+2])}
+
+		j := nq.contest(c)
+		nq.alter(j, alpha, c)
+		if rad > 0 {
+			nq.alterNeighbours(j, rad, alpha, c)
+		}
+
+		pos = (pos + step) % pixels
+
+		if i%delta == 0 {
+			alpha -= alpha / alphaDec
+			radius -= radius / neuQuantRadiusDecay
+			rad = neighbourhood(radius)
+		}
+	}
+}
+
+// neighbourhood returns the number of neurons either side of the winner that are
+// moved towards each sample, for the given radius.
+func neighbourhood(radius float64) int {
+	rad := int(radius)
+	if rad <= 1 {
+		return 0
+	}
+	return rad
+}
+
+// contest finds the neuron closest to c, and returns the neuron with the best
+// biased distance, which favours neurons that have not won recently so that
+// every neuron is used.
+func (nq *NeuQuant) contest(c [3]float64) int {
+	var (
+		bestDist, bestBiasDist = math.MaxFloat64, math.MaxFloat64
+		bestPos, bestBiasPos   int
+	)
+
+	for i, n := range nq.network {
+		dist := math.Abs(n[0]-c[0]) + math.Abs(n[1]-c[1]) + math.Abs(n[2]-c[2])
+		if dist < bestDist {
+			bestDist, bestPos = dist, i
+		}
+		if biasDist := dist - nq.bias[i]; biasDist < bestBiasDist {
+			bestBiasDist, bestBiasPos = biasDist, i
+		}
+
+		betaFreq := nq.freq[i] * neuQuantBeta
+		nq.freq[i] -= betaFreq
+		nq.bias[i] += betaFreq * neuQuantGamma
+	}
+
+	nq.freq[bestPos] += neuQuantBeta
+	nq.bias[bestPos] -= neuQuantBeta * neuQuantGamma
+
+	return bestBiasPos
+}
+
+// alter moves neuron i towards c by the factor alpha.
+func (nq *NeuQuant) alter(i int, alpha float64, c [3]float64) {
+	n := &nq.network[i]
+	for ch := range n {
+		n[ch] -= alpha * (n[ch] - c[ch])
+	}
+}
+
+// alterNeighbours moves the rad-1 neurons either side of neuron i towards c, by
+// a factor that falls from alpha to 0 with distance from i.
+func (nq *NeuQuant) alterNeighbours(i, rad int, alpha float64, c [3]float64) {
+	for m := 1; m < rad; m++ {
+		a := alpha * float64(rad*rad-m*m) / float64(rad*rad)
+		if j := i + m; j < len(nq.network) {
+			nq.alter(j, a, c)
+		}
+		if k := i - m; k >= 0 {
+			nq.alter(k, a, c)
+		}
+	}
+}
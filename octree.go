@@ -0,0 +1,139 @@
+package wu2quant
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// Octree quantizes images with the octree algorithm of Gervautz and
+// Purgathofer. The colours of the image are inserted into a tree that divides
+// the RGB cube into eight at each level, then the nodes with the fewest pixels
+// at the deepest level are merged until the tree has no more leaves than the
+// palette has entries.
+//
+// Octree implements PalettedQuantizer, so it can be compared with Quantizer. It
+// is not safe for concurrent use.
+type Octree struct {
+	pipeline
+
+	nodes []octreeNode
+
+	// levels lists the nodes with children at each level, which are the nodes
+	// that can be merged.
+	levels [8][]int32
+}
+
+type octreeNode struct {
+	// children holds the index in Octree.nodes of each child, or 0 if the child
+	// does not exist; the root, at index 0, is never a child.
+	children [8]int32
+
+	// r, g and b are the sums of the colours of the n pixels below the node.
+	r, g, b float64
+	n       int64
+
+	leaf bool
+}
+
+func NewOctree() *Octree {
+	return &Octree{}
+}
+
+// Quantize implements image/draw.Quantizer. It appends up to cap(p) - len(p)
+// colors to p and returns the updated palette.
+func (o *Octree) Quantize(p color.Palette, m image.Image) color.Palette {
+	return o.quantize(o.build, p, m)
+}
+
+// ToPaletted returns a paletted version of m reduced to paletteColors.
+//
+// If m is not an *image.RGBA, it will be converted to one before quantization.
+// Depending on the image type, this may trigger very slow code paths.
+func (o *Octree) ToPaletted(paletteColors int, m image.Image, buf *Buffer) (*image.Paletted, error) {
+	return o.toPaletted(o.build, paletteColors, m, buf)
+}
+
+func (o *Octree) build(_ *image.RGBA, colors []weightedColor, paletteColors int) []color.RGBA {
+	o.nodes = append(o.nodes[:0], octreeNode{})
+	for level := range o.levels {
+		o.levels[level] = o.levels[level][:0]
+	}
+
+	leaves := 0
+	for i := range colors {
+		var (
+			c       = &colors[i]
+			rgba    = c.rgba()
+			n       = float64(c.n)
+			node    int32
+			r, g, b = int(rgba.R), int(rgba.G), int(rgba.B)
+		)
+
+		for level := 0; ; level++ {
+			nd := &o.nodes[node]
+			nd.r, nd.g, nd.b, nd.n = nd.r+c.r*n, nd.g+c.g*n, nd.b+c.b*n, nd.n+c.n
+			if level == len(o.levels) {
+				if !nd.leaf {
+					nd.leaf = true
+					leaves++
+				}
+				break
+			}
+
+			shift := uint(7 - level)
+			child := (r>>shift&1)<<2 | (g>>shift&1)<<1 | (b >> shift & 1)
+			next := nd.children[child]
+			if next == 0 {
+				if nd.children == ([8]int32{}) {
+					o.levels[level] = append(o.levels[level], node)
+				}
+				next = int32(len(o.nodes))
+				nd.children[child] = next
+				o.nodes = append(o.nodes, octreeNode{})
+			}
+			node = next
+		}
+	}
+
+	// Merging the deepest nodes first means every node that is merged only has
+	// leaves as children:
+	for level := len(o.levels) - 1; level >= 0 && leaves > paletteColors; level-- {
+		nodes := o.levels[level]
+		sort.SliceStable(nodes, func(i, j int) bool { return o.nodes[nodes[i]].n < o.nodes[nodes[j]].n })
+
+		for _, idx := range nodes {
+			if leaves <= paletteColors {
+				break
+			}
+			nd := &o.nodes[idx]
+			for _, child := range nd.children {
+				if child != 0 {
+					leaves--
+				}
+			}
+			nd.children = [8]int32{}
+			nd.leaf = true
+			leaves++
+		}
+	}
+
+	out := make([]color.RGBA, 0, leaves)
+	return o.appendLeaves(out, 0)
+}
+
+// appendLeaves appends the mean colour of each leaf below node to out, in
+// depth first order.
+func (o *Octree) appendLeaves(out []color.RGBA, node int32) []color.RGBA {
+	nd := &o.nodes[node]
+	if nd.leaf {
+		n := float64(nd.n)
+		return append(out, color.RGBA{R: round8(nd.r / n), G: round8(nd.g / n), B: round8(nd.b / n), A: 0xff})
+	}
+	for _, child := range nd.children {
+		if child != 0 {
+			out = o.appendLeaves(out, child)
+		}
+	}
+	return out
+}
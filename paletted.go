@@ -0,0 +1,145 @@
+package wu2quant
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// PalettedQuantizer is implemented by Quantizer and by the alternative
+// quantizers Octree, NeuQuant and KMeans, so that they can be swapped for one
+// another and compared on the same images.
+type PalettedQuantizer interface {
+	draw.Quantizer
+
+	// ToPaletted returns a paletted version of m reduced to paletteColors.
+	ToPaletted(paletteColors int, m image.Image, buf *Buffer) (*image.Paletted, error)
+}
+
+var (
+	_ PalettedQuantizer = &Quantizer{}
+	_ PalettedQuantizer = &Octree{}
+	_ PalettedQuantizer = &NeuQuant{}
+	_ PalettedQuantizer = &KMeans{}
+)
+
+// weightedColor is the mean colour of the pixels in one occupied cell of a
+// histogram, and the number of pixels in it.
+type weightedColor struct {
+	r, g, b float64
+	n       int64
+	cell    paletteIndex
+}
+
+func (c *weightedColor) rgba() color.RGBA {
+	return color.RGBA{R: round8(c.r), G: round8(c.g), B: round8(c.b), A: 0xff}
+}
+
+// round8 rounds v to the nearest 8-bit value.
+func round8(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(0xff, math.Round(v))))
+}
+
+// paletteBuilder builds a palette of up to paletteColors opaque colours for img,
+// whose occupied histogram cells are in colors.
+type paletteBuilder func(img *image.RGBA, colors []weightedColor, paletteColors int) []color.RGBA
+
+// pipeline is the conversion and output path shared by the alternative
+// quantizers. Each image is converted to an *image.RGBA, and its histogram is
+// built as it is for Wu's algorithm, recording the cell of each pixel in a
+// Buffer. The quantizer builds a palette from the occupied cells, or from the
+// image itself, and each cell is then mapped to the palette entry nearest to the
+// mean of its pixels.
+type pipeline struct {
+	hist   histogram3D
+	tag    tags
+	colors []weightedColor
+	dirty  bool
+}
+
+// histogram builds the histogram of img, recording the cell of each pixel in
+// qadd if it isn't nil, and collects the occupied cells into p.colors.
+func (p *pipeline) histogram(img *image.RGBA, qadd []paletteIndex) {
+	if p.dirty {
+		p.hist.clear()
+	}
+	p.hist.configure(ChannelWeights{}, false, false)
+	p.dirty = true
+
+	p.hist.build(img, qadd)
+
+	p.colors = p.colors[:0]
+	for r := 1; r <= 32; r++ {
+		for g := 1; g <= 32; g++ {
+			for b := 1; b <= 32; b++ {
+				n := p.hist.wt[r][g][b]
+				if n == 0 {
+					continue
+				}
+				p.colors = append(p.colors, weightedColor{
+					r:    float64(p.hist.mr[r][g][b]) / float64(n),
+					g:    float64(p.hist.mg[r][g][b]) / float64(n),
+					b:    float64(p.hist.mb[r][g][b]) / float64(n),
+					n:    n,
+					cell: paletteIndex((r << 10) + (r << 6) + r + (g << 5) + g + b),
+				})
+			}
+		}
+	}
+}
+
+// quantize implements draw.Quantizer for build. It appends up to
+// cap(pal) - len(pal) colours to pal.
+func (p *pipeline) quantize(build paletteBuilder, pal color.Palette, m image.Image) color.Palette {
+	paletteColors := cap(pal) - len(pal)
+	if err := checkPaletteColors(paletteColors, maxColors); err != nil {
+		panic(err)
+	}
+
+	img := convertToRGBA(m)
+	p.histogram(img, nil)
+	for _, c := range build(img, p.colors, paletteColors) {
+		pal = append(pal, c)
+	}
+	return pal
+}
+
+// toPaletted is ToPaletted for build. As with Quantizer, a paletteColors of 0
+// means 256.
+func (p *pipeline) toPaletted(build paletteBuilder, paletteColors int, m image.Image, buf *Buffer) (*image.Paletted, error) {
+	if paletteColors == 0 {
+		paletteColors = int(maxColors)
+	}
+	if err := checkPaletteColors(paletteColors, maxColors); err != nil {
+		return nil, fmt.Errorf("wu2quant: %w", err)
+	}
+
+	var (
+		img    = convertToRGBA(m)
+		bounds = img.Bounds()
+	)
+
+	buf = ensureBuffer(buf, bounds.Dx()*bounds.Dy())
+	p.histogram(img, buf.qadd)
+
+	colors := build(img, p.colors, paletteColors)
+	palette := make(color.Palette, len(colors))
+	for i, c := range colors {
+		palette[i] = c
+	}
+
+	for i := range p.colors {
+		c := &p.colors[i]
+		p.tag[c.cell] = nearestColor(colors, unitWeights, int(round8(c.r)), int(round8(c.g)), int(round8(c.b)), false)
+	}
+
+	// out's rows are contiguous, so qadd maps directly onto its pixels:
+	out := image.NewPaletted(bounds, palette)
+	for i, cell := range buf.qadd {
+		out.Pix[i] = uint8(p.tag[cell])
+	}
+
+	return out, nil
+}
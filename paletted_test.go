@@ -0,0 +1,236 @@
+package wu2quant
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// palettedQuantizers returns a fresh instance of each PalettedQuantizer, so they
+// can be run through the same tests and benchmarks.
+func palettedQuantizers() []struct {
+	name string
+	q    PalettedQuantizer
+} {
+	return []struct {
+		name string
+		q    PalettedQuantizer
+	}{
+		{"wu", New()},
+		{"octree", NewOctree()},
+		{"neuquant", NewNeuQuant()},
+		{"kmeans", NewKMeans()},
+	}
+}
+
+// palettedTestImages are the images every PalettedQuantizer is measured
+// against, along with the largest mean squared error each may produce at 64
+// colours.
+func palettedTestImages() []struct {
+	name   string
+	img    *image.RGBA
+	maxMSE float64
+} {
+	rng := rand.New(rand.NewSource(0))
+	return []struct {
+		name   string
+		img    *image.RGBA
+		maxMSE float64
+	}{
+		{"unique", genRGBAWithUniqueRGBPerPixel(256, 128), 400},
+		{"random", genRGBAWithRandomRGBPerPixel(rng, 128, 128), 1500},
+		// NeuQuant trains on too few pixels of an image this small to find
+		// every ring:
+		{"rings", genRings(genRandomRGBAPalette(rng, 32), 64), 150},
+	}
+}
+
+func TestPalettedQuantizers(t *testing.T) {
+	for _, img := range palettedTestImages() {
+		for _, pq := range palettedQuantizers() {
+			t.Run(img.name+"/"+pq.name, func(t *testing.T) {
+				result, err := pq.q.ToPaletted(64, img.img, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(result.Palette) == 0 || len(result.Palette) > 64 {
+					t.Fatal(len(result.Palette))
+				}
+				if result.Rect != img.img.Rect {
+					t.Fatal(result.Rect)
+				}
+				for _, idx := range result.Pix {
+					if int(idx) >= len(result.Palette) {
+						t.Fatal(idx)
+					}
+				}
+				mse := palettedMSE(img.img, result)
+				t.Logf("mse %.2f", mse)
+				if mse > img.maxMSE {
+					t.Fatal(mse)
+				}
+			})
+		}
+	}
+}
+
+func TestPalettedQuantizersQuantize(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	img := genRGBAWithRandomRGBPerPixel(rng, 64, 64)
+
+	for _, pq := range palettedQuantizers() {
+		t.Run(pq.name, func(t *testing.T) {
+			pal := pq.q.Quantize(make(color.Palette, 1, 17), img)
+			if len(pal) < 2 || len(pal) > 17 {
+				t.Fatal(len(pal))
+			}
+			for _, c := range pal[1:] {
+				if _, _, _, a := c.RGBA(); a != 0xffff {
+					t.Fatal(c)
+				}
+			}
+		})
+	}
+}
+
+func TestPalettedQuantizersInvalidSize(t *testing.T) {
+	img := genRGBAWithUniqueRGBPerPixel(16, 16)
+
+	for _, pq := range palettedQuantizers() {
+		for _, n := range []int{-1, 257} {
+			if _, err := pq.q.ToPaletted(n, img, nil); err == nil {
+				t.Fatal(pq.name, n)
+			}
+		}
+
+		// 0 means the largest palette:
+		result, err := pq.q.ToPaletted(0, img, nil)
+		if err != nil {
+			t.Fatal(pq.name, err)
+		}
+		if len(result.Palette) == 0 || len(result.Palette) > 256 {
+			t.Fatal(pq.name, len(result.Palette))
+		}
+	}
+}
+
+func TestPalettedQuantizersReuse(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	first := genRGBAWithRandomRGBPerPixel(rng, 64, 64)
+	second := genRGBAWithUniqueRGBPerPixel(64, 64)
+
+	for _, pq := range palettedQuantizers() {
+		t.Run(pq.name, func(t *testing.T) {
+			// A quantizer that has already seen an image should give the same
+			// result as a new one:
+			if _, err := pq.q.ToPaletted(32, first, nil); err != nil {
+				t.Fatal(err)
+			}
+			result, err := pq.q.ToPaletted(32, second, NewBuffer(0))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fresh := palettedQuantizers()
+			for _, f := range fresh {
+				if f.name != pq.name {
+					continue
+				}
+				exp, err := f.q.ToPaletted(32, second, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(exp, result) {
+					t.Fatal()
+				}
+			}
+		})
+	}
+}
+
+func TestPalettedQuantizersFewColors(t *testing.T) {
+	pal := genRandomRGBAPalette(rand.New(rand.NewSource(1)), 8)
+	img := genRings(pal, 16)
+
+	// Octree and k-means should find every colour exactly when there are no more
+	// of them than the palette allows:
+	for _, q := range []PalettedQuantizer{NewOctree(), NewKMeans()} {
+		result, err := q.ToPaletted(8, img, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mse := palettedMSE(img, result); mse != 0 {
+			t.Fatal(mse)
+		}
+	}
+}
+
+func TestKMeansSeed(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	img := genRGBAWithRandomRGBPerPixel(rng, 64, 64)
+
+	q := NewKMeans()
+	q.Seed = 42
+	exp := q.Quantize(make(color.Palette, 0, 16), img)
+	result := q.Quantize(make(color.Palette, 0, 16), img)
+	if !reflect.DeepEqual(exp, result) {
+		t.Fatal()
+	}
+
+	q.Seed = 43
+	result = q.Quantize(make(color.Palette, 0, 16), img)
+	if reflect.DeepEqual(exp, result) {
+		t.Fatal()
+	}
+}
+
+func TestNeuQuantSampleFactor(t *testing.T) {
+	img := genRGBAWithUniqueRGBPerPixel(64, 64)
+
+	for _, factor := range []int{-1, 31} {
+		q := NewNeuQuant()
+		q.SampleFactor = factor
+		if _, err := q.ToPaletted(16, img, nil); err == nil {
+			t.Fatal(factor)
+		}
+	}
+
+	for _, factor := range []int{1, 30} {
+		q := NewNeuQuant()
+		q.SampleFactor = factor
+		if _, err := q.ToPaletted(16, img, nil); err != nil {
+			t.Fatal(factor, err)
+		}
+	}
+}
+
+func TestKMeansIterations(t *testing.T) {
+	q := NewKMeans()
+	q.Iterations = -1
+	if _, err := q.ToPaletted(16, genRGBAWithUniqueRGBPerPixel(16, 16), nil); err == nil {
+		t.Fatal()
+	}
+}
+
+func BenchmarkPalettedQuantizers(b *testing.B) {
+	img := genRGBAWithUniqueRGBPerPixel(512, 256)
+
+	for _, pq := range palettedQuantizers() {
+		b.Run(pq.name, func(b *testing.B) {
+			buf := NewBuffer(512 * 256)
+			b.ReportAllocs()
+
+			var result *image.Paletted
+			for i := 0; i < b.N; i++ {
+				var err error
+				result, err = pq.q.ToPaletted(256, img, buf)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(palettedMSE(img, result), "mse")
+		})
+	}
+}
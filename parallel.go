@@ -0,0 +1,99 @@
+package wu2quant
+
+import (
+	"image"
+	"sync"
+)
+
+// parallelMinPixels is the smallest image for which Parallelism applies. Below
+// it, merging the histograms costs more than building them concurrently saves.
+const parallelMinPixels = 512 * 512
+
+// bands divides r into at most q.Parallelism bands of whole rows, to be
+// processed concurrently. If r is too small to be worth dividing, bands returns
+// nil.
+func (q *Quantizer) bands(r image.Rectangle) []image.Rectangle {
+	n := q.Parallelism
+	if n > r.Dy() {
+		n = r.Dy()
+	}
+	if n <= 1 || r.Dx()*r.Dy() < parallelMinPixels {
+		return nil
+	}
+
+	var (
+		rows = (r.Dy() + n - 1) / n
+		out  = make([]image.Rectangle, 0, n)
+	)
+	for y := r.Min.Y; y < r.Max.Y; y += rows {
+		band := image.Rect(r.Min.X, y, r.Max.X, y+rows)
+		out = append(out, band.Intersect(r))
+	}
+	return out
+}
+
+// buildParallel is like build, but builds each of q.bands in its own goroutine.
+// The first band is accumulated into q.hist, and the rest into q.partials,
+// which are then merged into q.hist and cleared.
+func (q *Quantizer) buildParallel(img *image.RGBA, qadd []paletteIndex) {
+	var (
+		bounds = img.Bounds()
+		bands  = q.bands(bounds)
+		wg     sync.WaitGroup
+	)
+
+	if bands == nil {
+		q.hist.build(img, qadd)
+		return
+	}
+
+	for len(q.partials) < len(bands)-1 {
+		q.partials = append(q.partials, new(histogram3D))
+	}
+
+	for i, band := range bands {
+		hist := &q.hist
+		if i > 0 {
+			hist = q.partials[i-1]
+			hist.configure(q.Weights, q.ColorSpace == ColorSpaceLinear, q.Precise)
+		}
+
+		var seg []paletteIndex
+		if qadd != nil {
+			start := (band.Min.Y - bounds.Min.Y) * bounds.Dx()
+			seg = qadd[start : start+band.Dx()*band.Dy()]
+		}
+
+		wg.Add(1)
+		go func(hist *histogram3D, band image.Rectangle, seg []paletteIndex) {
+			defer wg.Done()
+			hist.build(img.SubImage(band).(*image.RGBA), seg)
+		}(hist, band, seg)
+	}
+	wg.Wait()
+
+	for _, partial := range q.partials[:len(bands)-1] {
+		q.hist.merge(partial)
+		partial.clear()
+	}
+}
+
+// merge adds the moments of other, which must have been built by build with the
+// same configuration, to hist.
+func (hist *histogram3D) merge(other *histogram3D) {
+	for r := 1; r <= 32; r++ {
+		for g := 1; g <= 32; g++ {
+			for b := 1; b <= 32; b++ {
+				hist.wt[r][g][b] += other.wt[r][g][b]
+				hist.mr[r][g][b] += other.mr[r][g][b]
+				hist.mg[r][g][b] += other.mg[r][g][b]
+				hist.mb[r][g][b] += other.mb[r][g][b]
+				if hist.m2p != nil {
+					hist.m2p[r][g][b] += other.m2p[r][g][b]
+				} else {
+					hist.m2[r][g][b] += other.m2[r][g][b]
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package wu2quant
+
+import (
+	"image"
+	"image/color"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// defaultPoolBufferBytes is the default limit on the memory held by idle
+// buffers in a Pool, enough for a few 4096x4096 images.
+const defaultPoolBufferBytes = 128 << 20
+
+// PoolOptions controls the size of a Pool. The zero value is valid.
+type PoolOptions struct {
+	// New is called to create each Quantizer in the pool, and can be used to
+	// configure them. Quantizers must not be shared with anything else.
+	// Defaults to New.
+	New func() *Quantizer
+
+	// MaxQuantizers is the number of Quantizers the pool may create. Each is
+	// about 1.5MB, and is kept once created. Calls block while all of them are
+	// in use. Defaults to runtime.GOMAXPROCS(0).
+	MaxQuantizers int
+
+	// MaxBufferBytes limits the memory held by idle Buffers. A Buffer returned
+	// to the pool is discarded if keeping it would exceed the limit, starting
+	// with the smallest idle Buffers. Defaults to 128MB; set to a negative
+	// value to keep no Buffers.
+	MaxBufferBytes int64
+}
+
+// PoolStats describes the state of a Pool.
+type PoolStats struct {
+	// Quantizers is the number of Quantizers created, and InUse the number of
+	// those currently in use.
+	Quantizers, InUse int
+
+	// Waits is the number of calls that had to wait for a Quantizer.
+	Waits int64
+
+	// Buffers is the number of idle Buffers, and BufferBytes the memory they
+	// hold.
+	Buffers     int
+	BufferBytes int64
+
+	// BufferHits is the number of calls that reused an idle Buffer, and
+	// BufferMisses the number that had to allocate one.
+	BufferHits, BufferMisses int64
+}
+
+// Pool shares a bounded number of Quantizers and Buffers between goroutines. It
+// is safe for concurrent use, unlike Quantizer.
+type Pool struct {
+	opts PoolOptions
+	sem  chan struct{}
+
+	mu      sync.Mutex
+	idle    []*Quantizer
+	buffers []*Buffer
+	stats   PoolStats
+}
+
+// NewPool creates a Pool. If opts is nil, the defaults are used.
+func NewPool(opts *PoolOptions) *Pool {
+	var o PoolOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.New == nil {
+		o.New = New
+	}
+	if o.MaxQuantizers <= 0 {
+		o.MaxQuantizers = runtime.GOMAXPROCS(0)
+	}
+	if o.MaxBufferBytes == 0 {
+		o.MaxBufferBytes = defaultPoolBufferBytes
+	}
+	return &Pool{opts: o, sem: make(chan struct{}, o.MaxQuantizers)}
+}
+
+// Quantize is Quantizer.Quantize, using a Quantizer from the pool.
+func (p *Pool) Quantize(pal color.Palette, m image.Image) color.Palette {
+	q := p.get()
+	defer p.put(q)
+	return q.Quantize(pal, m)
+}
+
+// ToPaletted is Quantizer.ToPaletted, using a Quantizer and Buffer from the pool.
+func (p *Pool) ToPaletted(paletteColors int, m image.Image) (*image.Paletted, error) {
+	q := p.get()
+	defer p.put(q)
+	buf := p.getBuffer(m.Bounds())
+	defer p.putBuffer(buf)
+	return q.ToPaletted(paletteColors, m, buf)
+}
+
+// IntoPaletted is Quantizer.IntoPaletted, using a Quantizer and Buffer from the
+// pool.
+func (p *Pool) IntoPaletted(paletteColors int, m image.Image, o *image.Paletted) error {
+	q := p.get()
+	defer p.put(q)
+	buf := p.getBuffer(m.Bounds())
+	defer p.putBuffer(buf)
+	return q.IntoPaletted(paletteColors, m, o, buf)
+}
+
+// Stats returns a snapshot of the state of the pool.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+func (p *Pool) get() *Quantizer {
+	select {
+	case p.sem <- struct{}{}:
+	default:
+		p.mu.Lock()
+		p.stats.Waits++
+		p.mu.Unlock()
+		p.sem <- struct{}{}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stats.InUse++
+	if n := len(p.idle); n > 0 {
+		q := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		return q
+	}
+	p.stats.Quantizers++
+	return p.opts.New()
+}
+
+func (p *Pool) put(q *Quantizer) {
+	p.mu.Lock()
+	p.idle = append(p.idle, q)
+	p.stats.InUse--
+	p.mu.Unlock()
+	<-p.sem
+}
+
+// getBuffer returns the smallest idle Buffer large enough for an image with
+// bounds r, or a new Buffer if there is none.
+func (p *Pool) getBuffer(r image.Rectangle) *Buffer {
+	pixels := r.Dx() * r.Dy()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	best := -1
+	for i, buf := range p.buffers {
+		if cap(buf.qadd) >= pixels && (best < 0 || cap(buf.qadd) < cap(p.buffers[best].qadd)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		p.stats.BufferMisses++
+		return NewBuffer(pixels)
+	}
+
+	buf := p.buffers[best]
+	p.buffers = append(p.buffers[:best], p.buffers[best+1:]...)
+	p.stats.Buffers--
+	p.stats.BufferBytes -= buf.bytes()
+	p.stats.BufferHits++
+	return buf
+}
+
+// putBuffer returns buf to the pool, discarding the smallest idle Buffers,
+// including buf itself, until the idle Buffers fit in MaxBufferBytes.
+func (p *Pool) putBuffer(buf *Buffer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buffers = append(p.buffers, buf)
+	p.stats.Buffers++
+	p.stats.BufferBytes += buf.bytes()
+
+	for p.stats.BufferBytes > p.opts.MaxBufferBytes && len(p.buffers) > 0 {
+		smallest := 0
+		for i, b := range p.buffers {
+			if cap(b.qadd) < cap(p.buffers[smallest].qadd) {
+				smallest = i
+			}
+		}
+		p.stats.Buffers--
+		p.stats.BufferBytes -= p.buffers[smallest].bytes()
+		p.buffers = append(p.buffers[:smallest], p.buffers[smallest+1:]...)
+	}
+}
+
+// bytes returns the memory held by b.
+func (b *Buffer) bytes() int64 {
+	return int64(cap(b.qadd))*int64(unsafe.Sizeof(paletteIndex(0))) + int64(cap(b.narrow))
+}
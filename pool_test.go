@@ -0,0 +1,124 @@
+package wu2quant
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestPool(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	imgs := make([]*image.RGBA, 4)
+	exps := make([]*image.Paletted, len(imgs))
+	for i := range imgs {
+		imgs[i] = genRGBAWithRandomRGBPerPixel(rng, 50+i*10, 40)
+		q := New()
+		q.Split = SplitMedian
+		exp, err := q.ToPaletted(32, imgs[i], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exps[i] = exp
+	}
+
+	pool := NewPool(&PoolOptions{
+		MaxQuantizers: 2,
+		New: func() *Quantizer {
+			q := New()
+			q.Split = SplitMedian
+			return q
+		},
+	})
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []int
+	)
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, img := range imgs {
+				result, err := pool.ToPaletted(32, img)
+				if err != nil || !reflect.DeepEqual(result, exps[i]) {
+					mu.Lock()
+					failed = append(failed, i)
+					mu.Unlock()
+				}
+
+				out := image.NewPaletted(img.Bounds(), nil)
+				err = pool.IntoPaletted(32, img, out)
+				if err != nil || !reflect.DeepEqual(out, exps[i]) {
+					mu.Lock()
+					failed = append(failed, i)
+					mu.Unlock()
+				}
+
+				if p := pool.Quantize(make(color.Palette, 0, 32), img); !reflect.DeepEqual(p, exps[i].Palette) {
+					mu.Lock()
+					failed = append(failed, i)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		t.Fatal(failed)
+	}
+
+	stats := pool.Stats()
+	if stats.Quantizers < 1 || stats.Quantizers > 2 || stats.InUse != 0 {
+		t.Fatal(stats)
+	}
+	if stats.BufferHits+stats.BufferMisses != int64(8*len(imgs)*2) || stats.BufferHits == 0 {
+		t.Fatal(stats)
+	}
+	if stats.Buffers == 0 || stats.BufferBytes == 0 {
+		t.Fatal(stats)
+	}
+}
+
+func TestPoolBufferLimit(t *testing.T) {
+	var (
+		small = genRGBAWithRandomRGBPerPixel(nil, 10, 10)
+		large = genRGBAWithRandomRGBPerPixel(nil, 100, 100)
+		pool  = NewPool(&PoolOptions{MaxBufferBytes: 100 * 100 * 2})
+	)
+
+	if _, err := pool.ToPaletted(16, small); err != nil {
+		t.Fatal(err)
+	}
+	if stats := pool.Stats(); stats.Buffers != 1 || stats.BufferBytes != 10*10*2 {
+		t.Fatal(stats)
+	}
+
+	// The large buffer only fits if the small one is discarded:
+	if _, err := pool.ToPaletted(16, large); err != nil {
+		t.Fatal(err)
+	}
+	if stats := pool.Stats(); stats.Buffers != 1 || stats.BufferBytes != 100*100*2 || stats.BufferMisses != 2 {
+		t.Fatal(stats)
+	}
+
+	// The large buffer can be reused for the small image:
+	if _, err := pool.ToPaletted(16, small); err != nil {
+		t.Fatal(err)
+	}
+	if stats := pool.Stats(); stats.Buffers != 1 || stats.BufferHits != 1 {
+		t.Fatal(stats)
+	}
+
+	pool = NewPool(&PoolOptions{MaxBufferBytes: -1})
+	if _, err := pool.ToPaletted(16, small); err != nil {
+		t.Fatal(err)
+	}
+	if stats := pool.Stats(); stats.Buffers != 0 || stats.BufferBytes != 0 {
+		t.Fatal(stats)
+	}
+}
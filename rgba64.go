@@ -0,0 +1,198 @@
+package wu2quant
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// QuantizeRGBA64 is like QuantizeRGBAToPalette, but for images with 16 bits per
+// channel. Each pixel is still counted in the histogram cell given by the high
+// bits of its channels, but the moments accumulate the full 16-bit samples, so
+// each palette entry is rounded to 8 bits once, from the mean of the original
+// samples, rather than from the mean of samples already truncated to 8 bits.
+//
+// Exact, Sample, Dither, Transparent, the masks and generators other than
+// GeneratorWu are not supported by the 16-bit path; if any of them are set, m is
+// converted to an *image.RGBA and quantized by QuantizeRGBAToPalette instead.
+func (q *Quantizer) QuantizeRGBA64(p color.Palette, m *image.RGBA64) color.Palette {
+	if q.narrow() {
+		return q.QuantizeRGBAToPalette(p, convertToRGBA(m))
+	}
+
+	var cols quantizedColors
+	if err := q.quantize64(&cols, m, cap(p)-len(p), nil); err != nil {
+		panic(err)
+	}
+	return cols.appendTo(p)
+}
+
+// RGBA64ToPaletted is like RGBAToPaletted, but for images with 16 bits per
+// channel. See QuantizeRGBA64.
+func (q *Quantizer) RGBA64ToPaletted(paletteColors int, m *image.RGBA64, buf *Buffer) (*image.Paletted, error) {
+	if q.narrow() {
+		return q.RGBAToPaletted(paletteColors, convertToRGBA(m), buf)
+	}
+	paletteColors = q.paletteColors(paletteColors)
+
+	var (
+		cols   quantizedColors
+		bounds = m.Bounds()
+	)
+
+	buf = ensureBuffer(buf, bounds.Dx()*bounds.Dy())
+	if err := q.quantize64(&cols, m, paletteColors, buf.qadd); err != nil {
+		return nil, err
+	}
+
+	out := image.NewPaletted(bounds, cols.appendTo(make(color.Palette, 0, cols.paletteSize)))
+	q.mapParallel(out, bounds, buf.qadd, nil)
+
+	return out, nil
+}
+
+// RGBA64IntoPaletted is like RGBAIntoPaletted, but for images with 16 bits per
+// channel. See QuantizeRGBA64.
+func (q *Quantizer) RGBA64IntoPaletted(paletteColors int, m *image.RGBA64, o *image.Paletted, buf *Buffer) error {
+	if q.narrow() {
+		return q.RGBAIntoPaletted(paletteColors, convertToRGBA(m), o, buf)
+	}
+	paletteColors = q.paletteColors(paletteColors)
+
+	var (
+		cols   quantizedColors
+		bounds = m.Bounds()
+	)
+
+	if bounds != o.Bounds() {
+		return fmt.Errorf("wu2quant: input image m bounds %v did not match output image bounds %v", bounds, o.Bounds())
+	}
+
+	buf = ensureBuffer(buf, bounds.Dx()*bounds.Dy())
+	if err := q.quantize64(&cols, m, paletteColors, buf.qadd); err != nil {
+		return err
+	}
+
+	o.Palette = cols.appendTo(o.Palette[:0])
+	q.mapParallel(o, bounds, buf.qadd, nil)
+
+	return nil
+}
+
+// narrow reports whether q uses options that are only supported for 8-bit
+// images.
+func (q *Quantizer) narrow() bool {
+	return q.useExact() || q.Sample.Mode != SampleAll || q.PaletteMask != nil || q.MapMask != nil ||
+		q.Dither || q.Transparent || q.Generator != GeneratorWu
+}
+
+func (q *Quantizer) quantize64(into *quantizedColors, img *image.RGBA64, paletteColors int, qadd []paletteIndex) error {
+	if err := q.validate(paletteColors); err != nil {
+		return err
+	}
+
+	q.reset()
+	q.hist.build64(img, qadd)
+	q.palette(into, paletteColors)
+
+	return nil
+}
+
+// build64 is build for images with 16 bits per channel. The cell of each pixel
+// is chosen by the high 5 bits of each channel, as in build, but the moments
+// accumulate the 16-bit samples (or their linear light equivalents).
+func (hist *histogram3D) build64(img *image.RGBA64, qadd []paletteIndex) {
+	var (
+		bounds = img.Bounds()
+		linear = hist.sampleTable().linear
+		w      = hist.weights
+		m2p    = hist.m2p
+		qidx   int
+	)
+
+	var lin *[1 << 16]uint16
+	if linear {
+		lin = srgb16ToLinearTable()
+	}
+
+	hist.wide = true
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		pix := img.Pix[img.PixOffset(bounds.Min.X, y):][:bounds.Dx()*8]
+		for idx := 0; idx < len(pix); idx += 8 {
+			var (
+				r16 = int64(pix[idx])<<8 | int64(pix[idx+1])
+				g16 = int64(pix[idx+2])<<8 | int64(pix[idx+3])
+				b16 = int64(pix[idx+4])<<8 | int64(pix[idx+5])
+
+				inr, ing, inb = (r16 >> 11) + 1, (g16 >> 11) + 1, (b16 >> 11) + 1
+			)
+
+			if qadd != nil {
+				qadd[qidx] = paletteIndex((inr << 10) + (inr << 6) + inr + (ing << 5) + ing + inb)
+				qidx++
+			}
+
+			if linear {
+				r16, g16, b16 = int64(lin[r16]), int64(lin[g16]), int64(lin[b16])
+			}
+
+			hist.wt[inr][ing][inb]++
+			hist.mr[inr][ing][inb] += r16
+			hist.mg[inr][ing][inb] += g16
+			hist.mb[inr][ing][inb] += b16
+			if m2p != nil {
+				m2p[inr][ing][inb] += float64(w.R)*float64(r16*r16) + float64(w.G)*float64(g16*g16) + float64(w.B)*float64(b16*b16)
+			} else {
+				hist.m2[inr][ing][inb] += w.R*float32(r16*r16) + w.G*float32(g16*g16) + w.B*float32(b16*b16)
+			}
+		}
+	}
+}
+
+type rgba64AtImage interface {
+	image.Image
+	RGBA64At(x, y int) color.RGBA64
+}
+
+// isWide reports whether m is one of the standard library's image types with 16
+// bits per channel.
+func isWide(m image.Image) bool {
+	switch m.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+func convertToRGBA64(img image.Image) *image.RGBA64 {
+	if img, ok := img.(*image.RGBA64); ok {
+		return img
+	}
+
+	var (
+		bounds  = img.Bounds()
+		out     = image.NewRGBA64(bounds)
+		at64, _ = img.(rgba64AtImage)
+		idx     int
+	)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var r, g, b, a uint32
+			if at64 != nil {
+				c := at64.RGBA64At(x, y)
+				r, g, b, a = uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A)
+			} else {
+				r, g, b, a = img.At(x, y).RGBA()
+			}
+			out.Pix[idx], out.Pix[idx+1] = uint8(r>>8), uint8(r)
+			out.Pix[idx+2], out.Pix[idx+3] = uint8(g>>8), uint8(g)
+			out.Pix[idx+4], out.Pix[idx+5] = uint8(b>>8), uint8(b)
+			out.Pix[idx+6], out.Pix[idx+7] = uint8(a>>8), uint8(a)
+			idx += 8
+		}
+	}
+
+	return out
+}
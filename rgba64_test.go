@@ -0,0 +1,106 @@
+package wu2quant
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestQuantizeRGBA64(t *testing.T) {
+	img := image.NewRGBA64(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			img.SetRGBA64(x, y, color.RGBA64{0x12ff, 0x3480, 0x567f, 0xffff})
+		}
+	}
+
+	// Truncating to 8 bits first loses the low byte:
+	out := New().QuantizeRGBAToPalette(make(color.Palette, 0, 1), convertToRGBA(img))
+	if out[0] != (color.RGBA{0x12, 0x34, 0x56, 0xff}) {
+		t.Fatal(out)
+	}
+
+	out = New().Quantize(make(color.Palette, 0, 1), img)
+	if out[0] != (color.RGBA{0x13, 0x34, 0x56, 0xff}) {
+		t.Fatal(out)
+	}
+}
+
+func TestQuantizeRGBA64Linear(t *testing.T) {
+	img := image.NewRGBA64(image.Rect(0, 0, 2, 1))
+	img.SetRGBA64(0, 0, color.RGBA64{0x0000, 0x0000, 0x0000, 0xffff})
+	img.SetRGBA64(1, 0, color.RGBA64{0xffff, 0xffff, 0xffff, 0xffff})
+
+	q := New()
+	q.ColorSpace = ColorSpaceLinear
+	out := q.QuantizeRGBA64(make(color.Palette, 0, 1), img)
+	if out[0] != (color.RGBA{0xbc, 0xbc, 0xbc, 0xff}) {
+		t.Fatal(out)
+	}
+}
+
+func TestRGBA64ToPaletted(t *testing.T) {
+	var (
+		pal = []color.NRGBA64{
+			{0x1000, 0x2000, 0x3000, 0xffff},
+			{0xf0ff, 0x80ff, 0x10ff, 0xffff},
+			{0x8000, 0x8000, 0x8000, 0xffff},
+		}
+		exp = []color.RGBA{
+			{0x10, 0x20, 0x30, 0xff},
+			{0xf0, 0x80, 0x11, 0xff},
+			{0x80, 0x80, 0x80, 0xff},
+		}
+		img = image.NewNRGBA64(image.Rect(0, 0, 30, 30))
+	)
+
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 30; x++ {
+			img.SetNRGBA64(x, y, pal[(x+y)%len(pal)])
+		}
+	}
+
+	sub := img.SubImage(image.Rect(5, 5, 25, 25))
+	for _, into := range []bool{false, true} {
+		var result *image.Paletted
+		if into {
+			result = image.NewPaletted(sub.Bounds(), nil)
+			if err := New().IntoPaletted(8, sub, result, nil); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			var err error
+			if result, err = New().ToPaletted(8, sub, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if len(result.Palette) != len(pal) {
+			t.Fatal(into, len(result.Palette))
+		}
+		for y := 5; y < 25; y++ {
+			for x := 5; x < 25; x++ {
+				if c := result.At(x, y); c != exp[(x+y)%len(pal)] {
+					t.Fatal(into, x, y, c)
+				}
+			}
+		}
+	}
+}
+
+func TestRGBA64Narrow(t *testing.T) {
+	img := image.NewRGBA64(image.Rect(0, 0, 2, 1))
+	img.SetRGBA64(0, 0, color.RGBA64{0x12ff, 0x12ff, 0x12ff, 0xffff})
+	img.SetRGBA64(1, 0, color.RGBA64{0x13ff, 0x13ff, 0x13ff, 0xffff})
+
+	// Exact is only supported for 8-bit images, so the colours are truncated:
+	q := New()
+	q.Exact = true
+	out, err := q.RGBA64ToPaletted(4, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Palette) != 2 || out.Palette[0] != (color.RGBA{0x12, 0x12, 0x12, 0xff}) || out.Palette[1] != (color.RGBA{0x13, 0x13, 0x13, 0xff}) {
+		t.Fatal(out.Palette)
+	}
+}
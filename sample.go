@@ -0,0 +1,107 @@
+package wu2quant
+
+import (
+	"fmt"
+	"image"
+	"math/rand"
+)
+
+// SampleMode selects how pixels are sampled when building a palette.
+type SampleMode int
+
+const (
+	// SampleAll uses every pixel.
+	SampleAll SampleMode = iota
+
+	// SampleEvery uses every Nth pixel, counting along each row and continuing
+	// onto the next.
+	SampleEvery
+
+	// SampleGrid uses the pixels at every Nth column of every Nth row.
+	SampleGrid
+
+	// SampleRandom uses N pixels chosen at random, using Seed to seed the random
+	// number generator. Pixels may be chosen more than once. If the image has N
+	// or fewer pixels, every pixel is used.
+	SampleRandom
+)
+
+// Sampling builds the palette from a subset of the pixels in an image, which is
+// much faster for large images at the cost of some quality. It is intended for
+// thumbnails and previews. The zero value uses every pixel.
+type Sampling struct {
+	Mode SampleMode
+	N    int
+	Seed int64
+}
+
+func (s Sampling) validate() error {
+	switch s.Mode {
+	case SampleAll:
+		return nil
+	case SampleEvery, SampleGrid, SampleRandom:
+		if s.N <= 0 {
+			return fmt.Errorf("sampling N must be > 0; found %d", s.N)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown sample mode %d", s.Mode)
+	}
+}
+
+// sample is like buildMasked, but only accumulates the pixels selected by s. It
+// does not record the cell of each pixel.
+func (hist *histogram3D) sample(img *image.RGBA, s Sampling, mask *image.Alpha) {
+	var (
+		bounds = img.Bounds()
+		width  = bounds.Dx()
+		height = bounds.Dy()
+		pix    = img.Pix
+	)
+
+	switch s.Mode {
+	case SampleEvery:
+		x := 0
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			row := pix[img.PixOffset(bounds.Min.X, y):]
+			for ; x < width; x += s.N {
+				if maskedOut(mask, bounds.Min.X+x, y) {
+					continue
+				}
+				idx := x * 4
+				hist.add(int64(row[idx]), int64(row[idx+1]), int64(row[idx+2]))
+			}
+			x -= width
+		}
+
+	case SampleGrid:
+		for y := bounds.Min.Y; y < bounds.Max.Y; y += s.N {
+			row := pix[img.PixOffset(bounds.Min.X, y):]
+			for x := 0; x < width; x += s.N {
+				if maskedOut(mask, bounds.Min.X+x, y) {
+					continue
+				}
+				idx := x * 4
+				hist.add(int64(row[idx]), int64(row[idx+1]), int64(row[idx+2]))
+			}
+		}
+
+	case SampleRandom:
+		if s.N >= width*height {
+			hist.buildMasked(img, mask, nil)
+			return
+		}
+		rng := rand.New(rand.NewSource(s.Seed))
+		for i := 0; i < s.N; i++ {
+			x, y := bounds.Min.X+rng.Intn(width), bounds.Min.Y+rng.Intn(height)
+			if maskedOut(mask, x, y) {
+				continue
+			}
+			idx := img.PixOffset(x, y)
+			hist.add(int64(pix[idx]), int64(pix[idx+1]), int64(pix[idx+2]))
+		}
+
+	default:
+		hist.buildMasked(img, mask, nil)
+	}
+}
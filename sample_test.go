@@ -0,0 +1,137 @@
+package wu2quant
+
+import (
+	"image"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// palettedMSE returns the mean squared error per pixel, summed over the R, G and
+// B channels, between img and its quantized version p.
+func palettedMSE(img *image.RGBA, p *image.Paletted) float64 {
+	var sum float64
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			a := img.RGBAAt(x, y)
+			r, g, b, _ := p.At(x, y).RGBA()
+			dr, dg, db := float64(a.R)-float64(r>>8), float64(a.G)-float64(g>>8), float64(a.B)-float64(b>>8)
+			sum += dr*dr + dg*dg + db*db
+		}
+	}
+	return sum / float64(bounds.Dx()*bounds.Dy())
+}
+
+func TestSamplingEveryPixel(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	img := genRGBAWithRandomRGBPerPixel(rng, 100, 50)
+	sub := img.SubImage(image.Rect(3, 3, 97, 47))
+
+	exp, err := New().ToPaletted(16, sub, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []SampleMode{SampleEvery, SampleGrid} {
+		q := New()
+		q.Sample = Sampling{Mode: mode, N: 1}
+		result, err := q.ToPaletted(16, sub, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(exp, result) {
+			t.Fatal(mode)
+		}
+	}
+}
+
+func TestSampling(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	img := genRGBAWithRandomRGBPerPixel(rng, 200, 200)
+
+	full, err := New().ToPaletted(64, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullMSE := palettedMSE(img, full)
+
+	for _, sampling := range []Sampling{
+		{Mode: SampleEvery, N: 7},
+		{Mode: SampleGrid, N: 4},
+		{Mode: SampleRandom, N: 2000, Seed: 1},
+	} {
+		q := New()
+		q.Sample = sampling
+		result, err := q.ToPaletted(64, img, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Palette) != 64 {
+			t.Fatal(sampling, len(result.Palette))
+		}
+
+		// Sampling a uniformly random image shouldn't lose much:
+		if mse := palettedMSE(img, result); mse > fullMSE*1.2 {
+			t.Fatal(sampling, mse, fullMSE)
+		}
+
+		again, err := q.ToPaletted(64, img, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(result, again) {
+			t.Fatal(sampling)
+		}
+	}
+}
+
+func TestSamplingInvalid(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	for _, sampling := range []Sampling{
+		{Mode: SampleEvery},
+		{Mode: SampleRandom, N: -1},
+		{Mode: 100, N: 1},
+	} {
+		q := New()
+		q.Sample = sampling
+		if _, err := q.ToPaletted(8, img, nil); err == nil {
+			t.Fatal(sampling)
+		}
+	}
+}
+
+// BenchmarkSampling compares the speed of building a palette from a sample
+// against the quality of the result, reported as the mean squared error per
+// pixel.
+func BenchmarkSampling(b *testing.B) {
+	img := genRGBAWithRandomRGBPerPixel(nil, 1024, 1024)
+	buf := NewBuffer(1024 * 1024)
+
+	for _, bc := range []struct {
+		name     string
+		sampling Sampling
+	}{
+		{"all", Sampling{}},
+		{"every-4", Sampling{Mode: SampleEvery, N: 4}},
+		{"every-16", Sampling{Mode: SampleEvery, N: 16}},
+		{"grid-4", Sampling{Mode: SampleGrid, N: 4}},
+		{"grid-16", Sampling{Mode: SampleGrid, N: 16}},
+		{"random-10000", Sampling{Mode: SampleRandom, N: 10000}},
+		{"random-1000", Sampling{Mode: SampleRandom, N: 1000}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			q := New()
+			q.Sample = bc.sampling
+
+			var out *image.Paletted
+			for i := 0; i < b.N; i++ {
+				out, _ = q.ToPaletted(256, img, buf)
+			}
+
+			b.StopTimer()
+			b.ReportMetric(palettedMSE(img, out), "mse")
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package wu2quant
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+)
+
+// Sequence quantizes consecutive frames of a video or animation. Quantizing each
+// frame independently causes the palette to jump around between frames, which
+// shows up as flicker; Sequence instead keeps using the previous frame's palette
+// until it no longer represents the current frame well enough.
+//
+// When a new palette is built, its entries are matched to the closest entries of
+// the previous palette so that areas which have not changed keep the same
+// indices from frame to frame.
+//
+// Every pixel of each frame is used to build the palette and is mapped through
+// the histogram cells, so the Quantizer's Transparent, Dither, Exact, Sample,
+// Parallelism, PaletteMask and MapMask are ignored.
+//
+// A Sequence is not safe for concurrent use.
+type Sequence struct {
+	// Threshold is the mean squared error per pixel, summed over the R, G and B
+	// channels and scaled by the Quantizer's Weights, above which a new palette
+	// is built for a frame. A threshold of 0 builds a new palette for every frame
+	// that isn't represented exactly.
+	//
+	// The error includes the loss inherent in reducing the frame to the palette
+	// size, so a useful threshold depends on both the content and the number of
+	// colors.
+	Threshold float64
+
+	q       *Quantizer
+	colors  int
+	rebuilt bool
+	palette color.Palette
+
+	// lut maps each histogram cell to an index in palette:
+	lut tags
+}
+
+// NewSequence creates a Sequence that quantizes frames to paletteColors using q.
+// If q is nil, a new Quantizer is allocated. If paletteColors is 0, the
+// Quantizer's Colors is used.
+func NewSequence(q *Quantizer, paletteColors int, threshold float64) *Sequence {
+	if q == nil {
+		q = New()
+	}
+	return &Sequence{q: q, colors: q.paletteColors(paletteColors), Threshold: threshold}
+}
+
+// Rebuilt reports whether the most recent frame caused a new palette to be built.
+func (s *Sequence) Rebuilt() bool {
+	return s.rebuilt
+}
+
+// Palette returns the palette used for the most recent frame.
+func (s *Sequence) Palette() color.Palette {
+	return s.palette
+}
+
+// ToPaletted quantizes the next frame in the sequence, returning a paletted version
+// of m.
+//
+// If m is not an *image.RGBA, it will be converted to one before quantization.
+// Depending on the image type, this may trigger very slow code paths.
+//
+// If you wish to control allocations, pass an instance of wu2quant.Buffer to buf.
+// If you don't care, pass 'nil'.
+func (s *Sequence) ToPaletted(m image.Image, buf *Buffer) (*image.Paletted, error) {
+	rgbImg := convertToRGBA(m)
+	return s.RGBAToPaletted(rgbImg, buf)
+}
+
+// If you wish to control allocations, pass an instance of wu2quant.Buffer to buf.
+// If you don't care, pass 'nil'.
+func (s *Sequence) RGBAToPaletted(m *image.RGBA, buf *Buffer) (*image.Paletted, error) {
+	if err := s.q.validate(s.colors); err != nil {
+		return nil, fmt.Errorf("wu2quant: %w", err)
+	}
+	if err := s.q.requireWu("Sequence"); err != nil {
+		return nil, fmt.Errorf("wu2quant: %w", err)
+	}
+
+	var (
+		q      = s.q
+		bounds = m.Bounds()
+		pixels = bounds.Dx() * bounds.Dy()
+	)
+
+	buf = ensureBuffer(buf, pixels)
+	q.reset()
+	q.hist.build(m, buf.qadd)
+
+	s.rebuilt = s.palette == nil || s.mappingError(pixels) > s.Threshold
+	if s.rebuilt {
+		var cols quantizedColors
+		q.palette(&cols, s.colors)
+		s.rebase(&cols)
+	}
+
+	out := image.NewPaletted(bounds, s.palette)
+	for i, cell := range buf.qadd {
+		out.Pix[i] = uint8(s.lut[cell])
+	}
+
+	return out, nil
+}
+
+// mappingError calculates the mean squared error per pixel of mapping the raw
+// histogram in s.q.hist to the current palette.
+//
+// For a cell containing n colours c, mapped to palette entry p, the sum of
+// squared errors for each channel is:
+//
+//	sum((c-p)^2) = sum(c^2) - 2*p*sum(c) + n*p^2
+//
+// which can be calculated directly from the histogram without visiting the image
+// again.
+func (s *Sequence) mappingError(pixels int) float64 {
+	if pixels == 0 {
+		return 0
+	}
+
+	var (
+		hist = &s.q.hist
+		w    = hist.weights
+		st   = hist.sampleTable()
+		err  float64
+	)
+
+	for r := 1; r <= 32; r++ {
+		for g := 1; g <= 32; g++ {
+			for b := 1; b <= 32; b++ {
+				wt := hist.wt[r][g][b]
+				if wt == 0 {
+					continue
+				}
+
+				// The palette entry must be in the same form as the values
+				// accumulated into the histogram:
+				p := s.palette[s.lut[(r<<10)+(r<<6)+r+(g<<5)+g+b]].(color.RGBA)
+				pr, pg, pb := float64(st.value[p.R]), float64(st.value[p.G]), float64(st.value[p.B])
+				wr, wg, wb := float64(w.R), float64(w.G), float64(w.B)
+
+				// m2 is already weighted by build:
+				err += hist.sumSquares(r, g, b) -
+					2*(wr*pr*float64(hist.mr[r][g][b])+wg*pg*float64(hist.mg[r][g][b])+wb*pb*float64(hist.mb[r][g][b])) +
+					float64(wt)*(wr*pr*pr+wg*pg*pg+wb*pb*pb)
+			}
+		}
+	}
+
+	return err / float64(pixels)
+}
+
+// rebase replaces the current palette with cols, assigning each new colour the
+// index of the closest unclaimed colour in the previous palette. Indices of the
+// previous palette that are not claimed retain their previous colour.
+func (s *Sequence) rebase(cols *quantizedColors) {
+	var (
+		next = cols.appendTo(make(color.Palette, 0, cols.paletteSize))
+		prev = s.palette
+		perm [maxColors]paletteIndex
+	)
+
+	if prev == nil {
+		for i := range next {
+			perm[i] = paletteIndex(i)
+		}
+		s.palette = next
+
+	} else {
+		type pair struct {
+			next, prev paletteIndex
+			dist       float32
+		}
+		pairs := make([]pair, 0, len(next)*len(prev))
+		for i, nc := range next {
+			for j, pc := range prev {
+				pairs = append(pairs, pair{paletteIndex(i), paletteIndex(j), rgbaDistance(nc.(color.RGBA), pc.(color.RGBA), s.q.hist.weights)})
+			}
+		}
+		sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].dist < pairs[j].dist })
+
+		var nextUsed, prevUsed [maxColors]bool
+		for _, p := range pairs {
+			if nextUsed[p.next] || prevUsed[p.prev] {
+				continue
+			}
+			nextUsed[p.next], prevUsed[p.prev] = true, true
+			perm[p.next] = p.prev
+		}
+
+		// Any colours left over once the previous palette is used up are
+		// appended to the end:
+		palette := append(make(color.Palette, 0, s.colors), prev...)
+		for i := range next {
+			if !nextUsed[i] {
+				perm[i] = paletteIndex(len(palette))
+				palette = append(palette, next[i])
+			} else {
+				palette[perm[i]] = next[i]
+			}
+		}
+		s.palette = palette
+	}
+
+	for cell, idx := range s.q.tag {
+		s.lut[cell] = perm[idx]
+	}
+}
+
+func rgbaDistance(a, b color.RGBA, w ChannelWeights) float32 {
+	dr, dg, db := float32(a.R)-float32(b.R), float32(a.G)-float32(b.G), float32(a.B)-float32(b.B)
+	return w.R*(dr*dr) + w.G*(dg*dg) + w.B*(db*db)
+}
@@ -0,0 +1,125 @@
+package wu2quant
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func genRings(pal []color.RGBA, size int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for i, j := 0, size-1; i < j; i, j = i+1, j-1 {
+		for p := i; p <= j; p++ {
+			img.SetRGBA(i, p, pal[i])
+			img.SetRGBA(j, p, pal[i])
+			img.SetRGBA(p, i, pal[i])
+			img.SetRGBA(p, j, pal[i])
+		}
+	}
+	return img
+}
+
+func TestSequenceReusesPalette(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	img := genRGBAWithRandomRGBPerPixel(rng, 64, 64)
+
+	s := NewSequence(nil, 16, 1e9)
+
+	first, err := s.ToPaletted(img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Rebuilt() {
+		t.Fatal()
+	}
+
+	// Nudging a pixel should not be enough to cross the threshold:
+	img.Pix[0] ^= 1
+	second, err := s.ToPaletted(img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Rebuilt() {
+		t.Fatal()
+	}
+	if !reflect.DeepEqual(first.Palette, second.Palette) {
+		t.Fatal()
+	}
+	if !reflect.DeepEqual(first.Pix[1:], second.Pix[1:]) {
+		t.Fatal()
+	}
+}
+
+func TestSequenceStableIndices(t *testing.T) {
+	pal := genRandomRGBAPalette(rand.New(rand.NewSource(0)), 10)
+	img1 := genRings(pal, 10)
+
+	pal[0] = color.RGBA{0x10, 0xf0, 0x10, 0xff}
+	img2 := genRings(pal, 10)
+
+	s := NewSequence(nil, 16, 0)
+	out1, err := s.ToPaletted(img1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out2, err := s.ToPaletted(img2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Rebuilt() {
+		t.Fatal()
+	}
+
+	// Only the outer ring changed, everything inside it should keep its index:
+	inner := image.Rect(1, 1, 9, 9)
+	for y := inner.Min.Y; y < inner.Max.Y; y++ {
+		for x := inner.Min.X; x < inner.Max.X; x++ {
+			if out1.ColorIndexAt(x, y) != out2.ColorIndexAt(x, y) {
+				t.Fatal(x, y)
+			}
+		}
+	}
+	if out2.At(0, 0) != pal[0] {
+		t.Fatal(out2.At(0, 0))
+	}
+
+	// Unrelated sequences should produce the same image, even though the
+	// indices may differ:
+	exp, err := New().ToPaletted(16, img2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			if exp.At(x, y) != out2.At(x, y) {
+				t.Fatal(x, y)
+			}
+		}
+	}
+}
+
+func TestSequenceInvalidColors(t *testing.T) {
+	for _, n := range []int{-1, 257} {
+		s := NewSequence(nil, n, 0)
+		if _, err := s.ToPaletted(image.NewRGBA(image.Rect(0, 0, 1, 1)), nil); err == nil {
+			t.Fatal(n)
+		}
+	}
+}
+
+func TestSequenceConfigColors(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	img := genRGBAWithRandomRGBPerPixel(rng, 32, 32)
+
+	q := New()
+	q.Colors = 8
+	result, err := NewSequence(q, 0, 0).ToPaletted(img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Palette) != 8 {
+		t.Fatal(len(result.Palette))
+	}
+}
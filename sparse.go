@@ -0,0 +1,182 @@
+package wu2quant
+
+import (
+	"image"
+	"sort"
+)
+
+// sparseMaxPixels is the largest image for which the histogram is built by
+// buildSparse. Larger images are likely to occupy enough cells that tracking
+// them costs more than it saves.
+const sparseMaxPixels = 128 * 128
+
+// useSparse reports whether the histogram for img should be built by
+// buildSparse.
+//
+// The sparse histogram only has the occupied coordinates along each axis, so
+// boxes are split in the same order as with the full histogram unless the
+// strategy measures distances along the axes, as SplitMedian and SplitVolume
+// do.
+func (q *Quantizer) useSparse(img *image.RGBA, mask *image.Alpha) bool {
+	if q.Split != SplitVariance && q.Split != SplitPopulation {
+		return false
+	}
+	pixels := img.Bounds().Dx() * img.Bounds().Dy()
+	return mask == nil && pixels > 0 && pixels <= sparseMaxPixels
+}
+
+// buildSparse is like build, but records each occupied cell so that the rest of
+// the algorithm can skip the empty ones. This saves clearing and summing the
+// whole histogram for small images with few colours, like icons and thumbnails.
+func (hist *histogram3D) buildSparse(img *image.RGBA, qadd []paletteIndex) {
+	var (
+		bounds = img.Bounds()
+		qidx   int
+	)
+
+	hist.sparse = true
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		pix := img.Pix[img.PixOffset(bounds.Min.X, y):][:bounds.Dx()*4]
+		for idx := 0; idx < len(pix); idx += 4 {
+			r8, g8, b8 := pix[idx], pix[idx+1], pix[idx+2]
+			if hist.wt[r8>>3+1][g8>>3+1][b8>>3+1] == 0 {
+				hist.cells = append(hist.cells, cellIndex(r8, g8, b8))
+			}
+			cell := hist.add(int64(r8), int64(g8), int64(b8))
+			if qadd != nil {
+				qadd[qidx] = cell
+				qidx++
+			}
+		}
+	}
+}
+
+// compact moves the occupied cells of a sparse histogram so that only the
+// coordinates that are occupied along each axis remain, in the same order. The
+// empty planes that are removed contribute nothing to the moments, so boxes in
+// the compacted histogram have exactly the same moments as the corresponding
+// boxes in the full histogram, but there are far fewer cells to visit.
+//
+// axes records the original coordinate of each compacted coordinate, starting
+// from 0 for the empty plane below the histogram.
+func (hist *histogram3D) compact() {
+	var used [3][33]bool
+	for _, cell := range hist.cells {
+		r, g, b := cellCoords(cell)
+		used[0][r], used[1][g], used[2][b] = true, true, true
+	}
+
+	var index [3][33]int
+	for axis := range hist.axes {
+		hist.axes[axis] = append(hist.axes[axis][:0], 0)
+		for c := 1; c <= 32; c++ {
+			if used[axis][c] {
+				index[axis][c] = len(hist.axes[axis])
+				hist.axes[axis] = append(hist.axes[axis], c)
+			}
+		}
+	}
+
+	// Each cell moves to a position with a lower or equal index, so moving them
+	// in order of index never overwrites a cell that hasn't been moved yet:
+	sort.Sort((*cellList)(&hist.cells))
+
+	for _, cell := range hist.cells {
+		r, g, b := cellCoords(cell)
+		cr, cg, cb := index[0][r], index[1][g], index[2][b]
+		if cr == r && cg == g && cb == b {
+			continue
+		}
+
+		hist.wt[cr][cg][cb], hist.wt[r][g][b] = hist.wt[r][g][b], 0
+		hist.mr[cr][cg][cb], hist.mr[r][g][b] = hist.mr[r][g][b], 0
+		hist.mg[cr][cg][cb], hist.mg[r][g][b] = hist.mg[r][g][b], 0
+		hist.mb[cr][cg][cb], hist.mb[r][g][b] = hist.mb[r][g][b], 0
+		hist.m2[cr][cg][cb], hist.m2[r][g][b] = hist.m2[r][g][b], 0
+		if hist.m2p != nil {
+			hist.m2p[cr][cg][cb], hist.m2p[r][g][b] = hist.m2p[r][g][b], 0
+		}
+	}
+
+	hist.compacted = true
+}
+
+// extent returns the box containing every cell of the histogram, which is
+// smaller than the full histogram if it has been compacted.
+func (hist *histogram3D) extent() box {
+	if !hist.compacted {
+		return box{rmax: 32, gmax: 32, bmax: 32, vol: 32 * 32 * 32}
+	}
+	nr, ng, nb := len(hist.axes[0])-1, len(hist.axes[1])-1, len(hist.axes[2])-1
+	return box{rmax: nr, gmax: ng, bmax: nb, vol: nr * ng * nb}
+}
+
+// cellAt returns the index into a tags table of the cell at r, g, b, which are
+// compacted coordinates if the histogram has been compacted.
+func (hist *histogram3D) cellAt(r, g, b int) paletteIndex {
+	if hist.compacted {
+		r, g, b = hist.axes[0][r], hist.axes[1][g], hist.axes[2][b]
+	}
+	return paletteIndex((r << 10) + (r << 6) + r + (g << 5) + g + b)
+}
+
+// mark is like the mark function, but translates the coordinates of cube if the
+// histogram has been compacted.
+func (hist *histogram3D) mark(cube *box, label paletteIndex, tag *tags) {
+	if !hist.compacted {
+		mark(cube, label, tag)
+		return
+	}
+	for r := cube.rmin + 1; r <= cube.rmax; r++ {
+		for g := cube.gmin + 1; g <= cube.gmax; g++ {
+			for b := cube.bmin + 1; b <= cube.bmax; b++ {
+				tag[hist.cellAt(r, g, b)] = label
+			}
+		}
+	}
+}
+
+// clearBox clears the cells inside cube.
+func (hist *histogram3D) clearBox(cube box) {
+	for r := cube.rmin + 1; r <= cube.rmax; r++ {
+		for g := cube.gmin + 1; g <= cube.gmax; g++ {
+			for b := cube.bmin + 1; b <= cube.bmax; b++ {
+				hist.wt[r][g][b] = 0
+				hist.mr[r][g][b], hist.mg[r][g][b], hist.mb[r][g][b] = 0, 0, 0
+				hist.m2[r][g][b] = 0
+				if hist.m2p != nil {
+					hist.m2p[r][g][b] = 0
+				}
+			}
+		}
+	}
+}
+
+// clearCells clears the occupied cells of a sparse histogram that hasn't been
+// compacted.
+func (hist *histogram3D) clearCells() {
+	for _, cell := range hist.cells {
+		r, g, b := cellCoords(cell)
+		hist.wt[r][g][b] = 0
+		hist.mr[r][g][b], hist.mg[r][g][b], hist.mb[r][g][b] = 0, 0, 0
+		hist.m2[r][g][b] = 0
+		if hist.m2p != nil {
+			hist.m2p[r][g][b] = 0
+		}
+	}
+}
+
+// cellCoords is the inverse of cellIndex, returning the histogram coordinates
+// of a cell.
+func cellCoords(cell paletteIndex) (r, g, b int) {
+	return int(cell) / (33 * 33), int(cell) / 33 % 33, int(cell) % 33
+}
+
+// cellList sorts cell indices in ascending order. sort.Slice is avoided as it
+// allocates on every call.
+type cellList []paletteIndex
+
+func (c cellList) Len() int           { return len(c) }
+func (c cellList) Less(i, j int) bool { return c[i] < c[j] }
+func (c cellList) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
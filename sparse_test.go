@@ -0,0 +1,104 @@
+package wu2quant
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func genRGBAWithRandomColorsFromPalette(rng *rand.Rand, pal []color.RGBA, w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetRGBA(x, y, pal[rng.Intn(len(pal))])
+		}
+	}
+	return img
+}
+
+// denseToPaletted is RGBAToPaletted, but always builds the full histogram.
+func denseToPaletted(q *Quantizer, paletteColors int, m *image.RGBA) *image.Paletted {
+	var (
+		cols quantizedColors
+		buf  = BufferFromDims(m.Bounds().Dx(), m.Bounds().Dy())
+	)
+	q.reset()
+	q.hist.build(m, buf.qadd)
+	q.palette(&cols, paletteColors)
+
+	out := image.NewPaletted(m.Bounds(), cols.appendTo(nil))
+	q.mapQadd(out, m.Bounds(), buf.qadd, nil)
+	return out
+}
+
+func TestSparseMatchesDense(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+
+	for i, configure := range []func(q *Quantizer){
+		func(q *Quantizer) {},
+		func(q *Quantizer) { q.Split = SplitPopulation },
+		func(q *Quantizer) { q.Weights = WeightsRec709 },
+		func(q *Quantizer) { q.ColorSpace = ColorSpaceLinear },
+		func(q *Quantizer) { q.Precise = true },
+		func(q *Quantizer) { q.Depth = DepthRGB444 },
+	} {
+		for _, sz := range []int{8, 20, 64} {
+			for _, colors := range []int{2, 16, 200} {
+				var (
+					img     = genRGBAWithRandomColorsFromPalette(rng, genRandomRGBAPalette(rng, colors), sz, sz)
+					sparse  = New()
+					dense   = New()
+					results [2]*image.Paletted
+				)
+				configure(sparse)
+				configure(dense)
+
+				// Run each twice so that the sparse Quantizer has to clear
+				// what it left behind:
+				for n := 0; n < 2; n++ {
+					var err error
+					if results[0], err = sparse.RGBAToPaletted(16, img, nil); err != nil {
+						t.Fatal(err)
+					}
+					if !sparse.hist.compacted {
+						t.Fatal(i, "not sparse")
+					}
+					results[1] = denseToPaletted(dense, 16, img)
+					if !reflect.DeepEqual(results[0], results[1]) {
+						t.Fatal(i, sz, colors, n)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSparseRecycled(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	imgs := []*image.RGBA{
+		genRGBAWithRandomRGBPerPixel(rng, 200, 200),
+		genRGBAWithRandomColorsFromPalette(rng, genRandomRGBAPalette(rng, 30), 16, 16),
+		genRGBAWithRandomColorsFromPalette(rng, genRandomRGBAPalette(rng, 5), 32, 8),
+		genRGBAWithRandomRGBPerPixel(rng, 150, 150),
+		genRGBAWithRandomColorsFromPalette(rng, genRandomRGBAPalette(rng, 100), 30, 30),
+	}
+
+	q := New()
+	for n := 0; n < 2; n++ {
+		for i, img := range imgs {
+			exp, err := New().RGBAToPaletted(64, img, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := q.RGBAToPaletted(64, img, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(exp, result) {
+				t.Fatal(n, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package wu2quant
+
+import (
+	"math"
+	"sync"
+)
+
+// linearMax is the largest value of a linear light channel. 16 bits is enough to
+// keep the darkest sRGB values distinct.
+const linearMax = 0xffff
+
+// srgbToLinear converts an 8-bit sRGB channel value to linear light.
+var srgbToLinear [256]uint16
+
+func init() {
+	for i := range srgbToLinear {
+		srgbToLinear[i] = uint16(math.Round(decodeSRGB(float64(i)/0xff) * linearMax))
+	}
+}
+
+var (
+	srgb16ToLinear     *[1 << 16]uint16
+	srgb16ToLinearOnce sync.Once
+)
+
+// srgb16ToLinearTable returns a table converting 16-bit sRGB channel values to
+// linear light. It is only built the first time it is needed, as it is much
+// larger than the 8-bit table.
+func srgb16ToLinearTable() *[1 << 16]uint16 {
+	srgb16ToLinearOnce.Do(func() {
+		srgb16ToLinear = new([1 << 16]uint16)
+		for i := range srgb16ToLinear {
+			srgb16ToLinear[i] = uint16(math.Round(decodeSRGB(float64(i)/0xffff) * linearMax))
+		}
+	})
+	return srgb16ToLinear
+}
+
+// decodeSRGB converts an sRGB channel value between 0 and 1 to linear light.
+func decodeSRGB(c float64) float64 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB converts a linear light channel value to 8-bit sRGB, rounding to
+// the nearest value.
+func linearToSRGB(v int64) uint8 {
+	if v <= 0 {
+		return 0
+	} else if v >= linearMax {
+		return 0xff
+	}
+
+	c := float64(v) / linearMax
+	if c <= 0.0031308 {
+		c *= 12.92
+	} else {
+		c = 1.055*math.Pow(c, 1/2.4) - 0.055
+	}
+	return uint8(math.Round(c * 0xff))
+}
@@ -0,0 +1,13 @@
+package wu2quant
+
+import (
+	"testing"
+)
+
+func TestSRGBRoundTrip(t *testing.T) {
+	for i := 0; i < 256; i++ {
+		if v := linearToSRGB(int64(srgbToLinear[i])); v != uint8(i) {
+			t.Fatal(i, v)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package wu2quant
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// Stream quantizes an image that is too large to hold in memory, in two passes
+// over bands of rows:
+//
+//   - Pass every band of the image to Add to accumulate the histogram.
+//   - Call Palette to build the palette.
+//   - Pass every band of the image to MapRows or WriteRows again to receive the
+//     palette index of each pixel, one row at a time.
+//
+// Bands may be any height, including a single row, and need not be passed in
+// the same order or with the same heights in both passes. Only the histogram
+// and a single row of indices are retained between calls.
+//
+// Every pixel passed to Add is counted, and MapRows maps each pixel through the
+// histogram cell it falls in. The Quantizer's Transparent, Dither, Exact,
+// Sample, Parallelism, PaletteMask and MapMask are ignored, so the palette never
+// has a transparent entry. Weights, ColorSpace and Precise take effect when
+// NewStream is called.
+//
+// Stream uses the histogram and lookup table of the Quantizer it was created
+// with, so the Quantizer must not be used for anything else until the Stream
+// is no longer needed.
+type Stream struct {
+	q       *Quantizer
+	palette color.Palette
+	row     []uint8
+}
+
+// NewStream starts a new streaming quantization using q. If q is nil, a new
+// Quantizer is allocated.
+func NewStream(q *Quantizer) *Stream {
+	if q == nil {
+		q = New()
+	}
+	q.reset()
+	return &Stream{q: q}
+}
+
+// Add accumulates the pixels in band into the histogram. Add must not be called
+// after Palette.
+func (s *Stream) Add(band *image.RGBA) error {
+	if s.palette != nil {
+		return fmt.Errorf("wu2quant: stream palette has already been built")
+	}
+	s.q.hist.build(band, nil)
+	return nil
+}
+
+// Palette builds a palette of up to paletteColors from the pixels passed to Add.
+// If paletteColors is 0, the Quantizer's Colors is used. Palette may only be
+// called once.
+func (s *Stream) Palette(paletteColors int) (color.Palette, error) {
+	if s.palette != nil {
+		return nil, fmt.Errorf("wu2quant: stream palette has already been built")
+	}
+	paletteColors = s.q.paletteColors(paletteColors)
+	if err := s.q.validate(paletteColors); err != nil {
+		return nil, fmt.Errorf("wu2quant: %w", err)
+	}
+	if err := s.q.requireWu("Stream"); err != nil {
+		return nil, fmt.Errorf("wu2quant: %w", err)
+	}
+
+	var cols quantizedColors
+	s.q.palette(&cols, paletteColors)
+	s.palette = cols.appendTo(make(color.Palette, 0, cols.paletteSize))
+
+	return s.palette, nil
+}
+
+// MapRows calls fn with the palette indices of each row in band, from top to
+// bottom. y is the row's coordinate in band. The row slice is reused between
+// calls, so fn must copy it if it needs to be retained.
+//
+// If fn returns an error, MapRows stops and returns it.
+func (s *Stream) MapRows(band *image.RGBA, fn func(y int, row []uint8) error) error {
+	if s.palette == nil {
+		return fmt.Errorf("wu2quant: stream palette has not been built")
+	}
+
+	var (
+		bounds = band.Bounds()
+		width  = bounds.Dx()
+		tag    = &s.q.tag
+	)
+
+	if cap(s.row) < width {
+		s.row = make([]uint8, width)
+	}
+	row := s.row[:width]
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		pix := band.Pix[band.PixOffset(bounds.Min.X, y):]
+		for x, idx := 0, 0; x < width; x, idx = x+1, idx+4 {
+			row[x] = uint8(tag[cellIndex(pix[idx], pix[idx+1], pix[idx+2])])
+		}
+		if err := fn(y, row); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteRows writes the palette indices of each pixel in band to w, one byte per
+// pixel, row by row with no padding.
+func (s *Stream) WriteRows(w io.Writer, band *image.RGBA) error {
+	return s.MapRows(band, func(y int, row []uint8) error {
+		_, err := w.Write(row)
+		return err
+	})
+}
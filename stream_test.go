@@ -0,0 +1,91 @@
+package wu2quant
+
+import (
+	"bytes"
+	"image"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestStreamMatchesToPaletted(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	img := genRGBAWithRandomRGBPerPixel(rng, 64, 50)
+
+	exp, err := New().ToPaletted(32, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStream(nil)
+
+	// Feed bands of varying heights in the first pass:
+	for y, h := 0, 1; y < 50; y, h = y+h, h+1 {
+		end := y + h
+		if end > 50 {
+			end = 50
+		}
+		if err := s.Add(img.SubImage(image.Rect(0, y, 64, end)).(*image.RGBA)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pal, err := s.Palette(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exp.Palette, pal) {
+		t.Fatal()
+	}
+
+	// And single rows in the second:
+	var out bytes.Buffer
+	for y := 0; y < 50; y++ {
+		if err := s.WriteRows(&out, img.SubImage(image.Rect(0, y, 64, y+1)).(*image.RGBA)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(exp.Pix, out.Bytes()) {
+		t.Fatal()
+	}
+}
+
+func TestStreamOrder(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	s := NewStream(nil)
+
+	if err := s.MapRows(img, func(y int, row []uint8) error { return nil }); err == nil {
+		t.Fatal()
+	}
+	if err := s.Add(img); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Palette(4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Palette(4); err == nil {
+		t.Fatal()
+	}
+	if err := s.Add(img); err == nil {
+		t.Fatal()
+	}
+}
+
+func TestStreamConfigColors(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	img := genRGBAWithRandomRGBPerPixel(rng, 32, 32)
+
+	q := New()
+	q.Colors = 8
+	s := NewStream(q)
+	if err := s.Add(img); err != nil {
+		t.Fatal(err)
+	}
+	palette, err := s.Palette(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(palette) != 8 {
+		t.Fatal(len(palette))
+	}
+}
@@ -0,0 +1,280 @@
+package wu2quant
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// tileIterations is the maximum number of times ToTiled rebuilds the
+// sub-palettes after reassigning tiles to the sub-palette that suits them best.
+const tileIterations = 4
+
+// TileOptions controls how ToTiled divides an image into tiles and sub-palettes.
+// The zero value produces 8x8 tiles with 4 sub-palettes of 16 colours.
+type TileOptions struct {
+	// TileWidth and TileHeight are the size of each tile in pixels. Both default
+	// to 8 if zero.
+	TileWidth, TileHeight int
+
+	// Palettes is the number of sub-palettes. Defaults to 4 if zero.
+	Palettes int
+
+	// Colors is the number of colours in each sub-palette. Defaults to 16 if zero.
+	// Palettes * Colors must not be more than 256.
+	Colors int
+}
+
+// TiledImage is an image quantized by ToTiled.
+type TiledImage struct {
+	// Image contains the quantized image. Its palette is the concatenation of
+	// Palettes, so pixel index i is colour i%Colors of sub-palette i/Colors, and
+	// every pixel in a tile refers to the same sub-palette.
+	Image *image.Paletted
+
+	// Palettes contains each sub-palette. Every sub-palette has exactly Colors
+	// entries; sub-palettes that need fewer are padded with opaque black.
+	Palettes []color.Palette
+
+	// Tiles contains the index of the sub-palette used by each tile, row by row.
+	Tiles []int
+
+	// Columns and Rows are the number of tiles across and down the image. Tiles
+	// on the right and bottom edges are partial if the image size is not a
+	// multiple of the tile size.
+	Columns, Rows int
+}
+
+// ToTiled quantizes m for tile-based hardware, where every tile of the image
+// must use one of a small number of sub-palettes.
+//
+// Tiles are first grouped by their mean colour, then a sub-palette is built for
+// each group using Wu's algorithm on the histogram of the group's tiles. Each
+// tile is then moved to the sub-palette that maps it with the least error, and
+// the sub-palettes are rebuilt, until no tiles move or a limit is reached.
+//
+// Every pixel is mapped to the nearest colour in its tile's sub-palette, whatever
+// Mapping is set to, and no sub-palette has a transparent entry. The Quantizer's
+// Exact, Sample, Transparent, Dither, Parallelism, PaletteMask and MapMask are
+// ignored.
+//
+// If m is not an *image.RGBA, it will be converted to one before quantization.
+// Depending on the image type, this may trigger very slow code paths.
+func (q *Quantizer) ToTiled(m image.Image, opts *TileOptions) (*TiledImage, error) {
+	var o TileOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.TileWidth == 0 {
+		o.TileWidth = 8
+	}
+	if o.TileHeight == 0 {
+		o.TileHeight = 8
+	}
+	if o.Palettes == 0 {
+		o.Palettes = 4
+	}
+	if o.Colors == 0 {
+		o.Colors = 16
+	}
+
+	if o.TileWidth < 0 || o.TileHeight < 0 {
+		return nil, fmt.Errorf("wu2quant: tile size must be positive; found %dx%d", o.TileWidth, o.TileHeight)
+	}
+	if o.Palettes < 0 || o.Colors < 0 || o.Palettes*o.Colors > int(maxColors) {
+		return nil, fmt.Errorf("wu2quant: %d sub-palettes of %d colours do not fit in a palette of %d", o.Palettes, o.Colors, maxColors)
+	}
+	if err := q.validate(o.Colors); err != nil {
+		return nil, fmt.Errorf("wu2quant: %w", err)
+	}
+	if err := q.requireWu("ToTiled"); err != nil {
+		return nil, fmt.Errorf("wu2quant: %w", err)
+	}
+
+	var (
+		img    = convertToRGBA(m)
+		bounds = img.Bounds()
+		out    = &TiledImage{
+			Columns: (bounds.Dx() + o.TileWidth - 1) / o.TileWidth,
+			Rows:    (bounds.Dy() + o.TileHeight - 1) / o.TileHeight,
+		}
+		tiles  = make([]*image.RGBA, out.Columns*out.Rows)
+		colors = make([][]color.RGBA, o.Palettes)
+		w      = q.Weights.orDefault()
+	)
+
+	for ty := 0; ty < out.Rows; ty++ {
+		for tx := 0; tx < out.Columns; tx++ {
+			r := image.Rect(tx*o.TileWidth, ty*o.TileHeight, (tx+1)*o.TileWidth, (ty+1)*o.TileHeight)
+			tiles[ty*out.Columns+tx] = img.SubImage(r.Add(bounds.Min).Intersect(bounds)).(*image.RGBA)
+		}
+	}
+
+	out.Tiles = groupTiles(tiles, o.Palettes, w)
+
+	for iter := 0; iter < tileIterations; iter++ {
+		for k := range colors {
+			if c := q.tilePalette(tiles, out.Tiles, k, o.Colors); c != nil {
+				colors[k] = c
+			}
+		}
+
+		moved := false
+		for i, tile := range tiles {
+			best, bestErr := out.Tiles[i], tileError(tile, colors[out.Tiles[i]], w)
+			for k, c := range colors {
+				if err := tileError(tile, c, w); err < bestErr {
+					best, bestErr = k, err
+				}
+			}
+			if best != out.Tiles[i] {
+				out.Tiles[i], moved = best, true
+			}
+		}
+		if !moved {
+			break
+		}
+	}
+
+	// If the last iteration moved any tiles, the sub-palettes aren't rebuilt to
+	// include them, but a tile is only moved to a sub-palette that suits it
+	// better than the one it left.
+	var palette color.Palette
+	for _, c := range colors {
+		sub := make(color.Palette, o.Colors)
+		for i := range sub {
+			if i < len(c) {
+				sub[i] = c[i]
+			} else {
+				sub[i] = color.RGBA{A: 0xff}
+			}
+		}
+		out.Palettes = append(out.Palettes, sub)
+		palette = append(palette, sub...)
+	}
+
+	out.Image = image.NewPaletted(bounds, palette)
+	for i, tile := range tiles {
+		var (
+			k     = out.Tiles[i]
+			c     = colors[k]
+			tb    = tile.Bounds()
+			first = uint8(k * o.Colors)
+		)
+		for y := tb.Min.Y; y < tb.Max.Y; y++ {
+			src := tile.Pix[tile.PixOffset(tb.Min.X, y):]
+			dst := out.Image.Pix[out.Image.PixOffset(tb.Min.X, y):][:tb.Dx()]
+			for x := range dst {
+				idx := nearestColor(c, w, int(src[x*4]), int(src[x*4+1]), int(src[x*4+2]), false)
+				dst[x] = first + uint8(idx)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// tilePalette builds a palette of up to paletteColors from the histogram of the
+// tiles assigned to group k. It returns nil if no tiles are assigned to k.
+func (q *Quantizer) tilePalette(tiles []*image.RGBA, groups []int, k int, paletteColors int) []color.RGBA {
+	q.reset()
+
+	empty := true
+	for i, tile := range tiles {
+		if groups[i] == k {
+			q.hist.build(tile, nil)
+			empty = false
+		}
+	}
+	if empty {
+		return nil
+	}
+
+	var cols quantizedColors
+	q.palette(&cols, paletteColors)
+
+	out := make([]color.RGBA, cols.paletteSize)
+	for i := range out {
+		out[i] = color.RGBA{R: cols.rLut[i], G: cols.gLut[i], B: cols.bLut[i], A: 0xff}
+	}
+	return out
+}
+
+// groupTiles makes an initial assignment of tiles to n groups by clustering the
+// mean colours of the tiles. The first group is centred on the first tile, and
+// each following group on the tile furthest from the centres chosen so far.
+func groupTiles(tiles []*image.RGBA, n int, w ChannelWeights) []int {
+	var (
+		means   = make([][3]float32, len(tiles))
+		groups  = make([]int, len(tiles))
+		dists   = make([]float32, len(tiles))
+		centres = make([][3]float32, 0, n)
+	)
+
+	for i, tile := range tiles {
+		var sum [3]int64
+		tb := tile.Bounds()
+		for y := tb.Min.Y; y < tb.Max.Y; y++ {
+			pix := tile.Pix[tile.PixOffset(tb.Min.X, y):][:tb.Dx()*4]
+			for idx := 0; idx < len(pix); idx += 4 {
+				sum[0] += int64(pix[idx])
+				sum[1] += int64(pix[idx+1])
+				sum[2] += int64(pix[idx+2])
+			}
+		}
+		px := float32(tb.Dx() * tb.Dy())
+		means[i] = [3]float32{float32(sum[0]) / px, float32(sum[1]) / px, float32(sum[2]) / px}
+		dists[i] = -1
+	}
+
+	dist := func(a, b [3]float32) float32 {
+		dr, dg, db := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+		return w.R*(dr*dr) + w.G*(dg*dg) + w.B*(db*db)
+	}
+
+	next := 0
+	for len(centres) < n && len(tiles) > 0 {
+		centre := means[next]
+		centres = append(centres, centre)
+
+		furthest := float32(0)
+		for i := range tiles {
+			if d := dist(means[i], centre); dists[i] < 0 || d < dists[i] {
+				dists[i], groups[i] = d, len(centres)-1
+			}
+			if dists[i] > furthest {
+				furthest, next = dists[i], i
+			}
+		}
+		if furthest == 0 {
+			break
+		}
+	}
+
+	return groups
+}
+
+// tileError returns the total weighted squared distance between each pixel in
+// tile and the nearest of colors. If colors is empty, no tile can be mapped to
+// it, so the error is the largest possible.
+func tileError(tile *image.RGBA, colors []color.RGBA, w ChannelWeights) float32 {
+	if len(colors) == 0 {
+		return math.MaxFloat32
+	}
+
+	var (
+		tb  = tile.Bounds()
+		sum float32
+	)
+	for y := tb.Min.Y; y < tb.Max.Y; y++ {
+		pix := tile.Pix[tile.PixOffset(tb.Min.X, y):][:tb.Dx()*4]
+		for idx := 0; idx < len(pix); idx += 4 {
+			r, g, b := int(pix[idx]), int(pix[idx+1]), int(pix[idx+2])
+			c := colors[nearestColor(colors, w, r, g, b, false)]
+			dr, dg, db := float32(r-int(c.R)), float32(g-int(c.G)), float32(b-int(c.B))
+			sum += w.R*(dr*dr) + w.G*(dg*dg) + w.B*(db*db)
+		}
+	}
+	return sum
+}
@@ -0,0 +1,101 @@
+package wu2quant
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+func TestToTiled(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+
+	// Each tile uses the colours of one of 3 groups, which fit exactly into 3
+	// sub-palettes of 4 colours:
+	var groups [3][]color.RGBA
+	for g := range groups {
+		groups[g] = genRandomRGBAPalette(rng, 4)
+	}
+
+	const cols, rows = 5, 4
+	img := image.NewRGBA(image.Rect(0, 0, cols*8-3, rows*8-5))
+	tileGroups := make([]int, cols*rows)
+	for i := range tileGroups {
+		tileGroups[i] = rng.Intn(len(groups))
+	}
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			g := groups[tileGroups[(y/8)*cols+x/8]]
+			img.SetRGBA(x, y, g[rng.Intn(len(g))])
+		}
+	}
+
+	result, err := New().ToTiled(img, &TileOptions{Palettes: 3, Colors: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Columns != cols || result.Rows != rows || len(result.Tiles) != cols*rows {
+		t.Fatal(result.Columns, result.Rows, len(result.Tiles))
+	}
+	if len(result.Palettes) != 3 || len(result.Image.Palette) != 12 {
+		t.Fatal(len(result.Palettes), len(result.Image.Palette))
+	}
+
+	// Tiles from the same group must share a sub-palette:
+	assigned := make(map[int]int)
+	for i, g := range tileGroups {
+		if k, ok := assigned[g]; ok && k != result.Tiles[i] {
+			t.Fatal(i, g, k, result.Tiles[i])
+		}
+		assigned[g] = result.Tiles[i]
+	}
+
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			tile := (y/8)*cols + x/8
+			idx := int(result.Image.ColorIndexAt(x, y))
+			if idx/4 != result.Tiles[tile] {
+				t.Fatal(x, y, idx, result.Tiles[tile])
+			}
+			if result.Image.At(x, y) != img.At(x, y) {
+				t.Fatal(x, y, result.Image.At(x, y), img.At(x, y))
+			}
+		}
+	}
+}
+
+func TestToTiledPadsPalettes(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			img.SetRGBA(x, y, color.RGBA{0xff, 0x00, 0x00, 0xff})
+		}
+	}
+
+	result, err := New().ToTiled(img, &TileOptions{Palettes: 2, Colors: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range result.Palettes {
+		if len(p) != 3 {
+			t.Fatal(p)
+		}
+	}
+	if result.Tiles[0] != result.Tiles[1] {
+		t.Fatal(result.Tiles)
+	}
+}
+
+func TestToTiledInvalid(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for _, opts := range []TileOptions{
+		{Palettes: 16, Colors: 17},
+		{TileWidth: -1},
+		{Colors: -1},
+	} {
+		if _, err := New().ToTiled(img, &opts); err == nil {
+			t.Fatal(opts)
+		}
+	}
+}
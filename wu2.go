@@ -4,20 +4,71 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
+	"sync"
 )
 
 type tags [33 * 33 * 33]paletteIndex
 
+// Quantizer reduces images to a palette using Wu's algorithm. Its behaviour is
+// controlled by the embedded Config, which may be changed between calls. The
+// zero value uses the default Config.
+//
+// A Quantizer holds about 1.5MB of working state, which is reused between calls,
+// so it is not safe for concurrent use. See Pool for sharing Quantizers between
+// goroutines.
 type Quantizer struct {
-	hist  histogram3D
-	tag   tags
-	dirty bool
+	Config
+
+	hist     histogram3D
+	tag      tags
+	exact    colorSet
+	dirty    bool
+	partials []*histogram3D
+	drawer   *Drawer
+
+	// boxes and priorities are used by palette, and are reused between calls.
+	boxes      []box
+	priorities []float32
 }
 
+// SplitStrategy selects which box the Quantizer splits next as it divides the
+// colour space into palette entries, and where that box is split.
+type SplitStrategy int
+
+const (
+	// SplitVariance is Wu's original strategy: the box with the largest weighted
+	// variance is split at the position that minimises the sum of the variances
+	// of the two halves.
+	SplitVariance SplitStrategy = iota
+
+	// SplitMedian is classic median cut: the box containing the most pixels is
+	// split at the population median along the longest axis of the colours it
+	// contains.
+	SplitMedian
+
+	// SplitPopulation splits the box containing the most pixels, at the position
+	// SplitVariance would choose.
+	SplitPopulation
+
+	// SplitVolume splits the box with the largest volume in colour space, at the
+	// position SplitVariance would choose.
+	SplitVolume
+)
+
 func New() *Quantizer {
 	return &Quantizer{}
 }
 
+// NewWithConfig returns a Quantizer using c, or an error describing the first
+// problem found with c.
+func NewWithConfig(c Config) (*Quantizer, error) {
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("wu2quant: %w", err)
+	}
+	return &Quantizer{Config: c}, nil
+}
+
 // Quantizes the color palette of an image.Image and returns the
 // palette as a color.Palette.
 //
@@ -27,8 +78,13 @@ func New() *Quantizer {
 // Quantize satisfies the image/draw.Quantizer interface.
 //
 // If m is not an *image.RGBA, it will be converted to one before quantization.
-// Depending on the image type, this may trigger very slow code paths.
+// Depending on the image type, this may trigger very slow code paths. Images
+// with 16 bits per channel are converted to an *image.RGBA64 instead, and are
+// quantized as described in QuantizeRGBA64.
 func (q *Quantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	if isWide(m) {
+		return q.QuantizeRGBA64(p, convertToRGBA64(m))
+	}
 	rgbImg := convertToRGBA(m)
 	return q.QuantizeRGBAToPalette(p, rgbImg)
 }
@@ -38,6 +94,11 @@ func (q *Quantizer) Quantize(p color.Palette, m image.Image) color.Palette {
 //
 // It appends up to cap(p) - len(p) colors to p and returns the
 // updated palette suitable for converting m to a paletted image.
+//
+// QuantizeRGBA panics if cap(p) - len(p) is not between 1 and 256, if the
+// Quantizer's Config is invalid, or if the Config can't produce a palette of
+// that size: a Generator whose levels need more colours, or Transparent with
+// room for only one colour when m has transparent pixels.
 func (q *Quantizer) QuantizeRGBA(p []color.RGBA, m *image.RGBA) []color.RGBA {
 	var cols quantizedColors
 	if err := q.quantize(&cols, m, cap(p)-len(p), nil); err != nil {
@@ -49,6 +110,9 @@ func (q *Quantizer) QuantizeRGBA(p []color.RGBA, m *image.RGBA) []color.RGBA {
 	for i := idx; i < end; i++ {
 		p = append(p, color.RGBA{R: cols.rLut[i], G: cols.gLut[i], B: cols.bLut[i], A: 0xff})
 	}
+	if cols.transparent {
+		p = append(p, color.RGBA{})
+	}
 
 	return p
 }
@@ -59,6 +123,8 @@ func (q *Quantizer) QuantizeRGBA(p []color.RGBA, m *image.RGBA) []color.RGBA {
 //
 // It appends up to cap(p) - len(p) colors to p and returns the updated palette suitable
 // for converting m to a paletted image.
+//
+// QuantizeRGBAToPalette panics under the same conditions as QuantizeRGBA.
 func (q *Quantizer) QuantizeRGBAToPalette(p color.Palette, m *image.RGBA) color.Palette {
 	var cols quantizedColors
 	if err := q.quantize(&cols, m, cap(p)-len(p), nil); err != nil {
@@ -70,19 +136,28 @@ func (q *Quantizer) QuantizeRGBAToPalette(p color.Palette, m *image.RGBA) color.
 	for i := idx; i < end; i++ {
 		p = append(p, color.RGBA{R: cols.rLut[i], G: cols.gLut[i], B: cols.bLut[i], A: 0xff})
 	}
+	if cols.transparent {
+		p = append(p, color.RGBA{})
+	}
 
 	return p
 }
 
 // ToPaletted accepts input image m and returns a paletted version of the image reduced
-// to paletteColors.
+// to paletteColors. If paletteColors is 0, the Quantizer's Colors is used.
 //
 // If m is not an *image.RGBA, it will be converted to one before quantization.
 // Depending on the image type, this may trigger very slow code paths.
 //
+// Images with 16 bits per channel are converted to an *image.RGBA64 instead, and
+// are quantized as described in QuantizeRGBA64.
+//
 // If you wish to control allocations, pass an instance of wu2quant.Buffer to buf.
 // If you don't care, pass 'nil'.
 func (q *Quantizer) ToPaletted(paletteColors int, m image.Image, buf *Buffer) (*image.Paletted, error) {
+	if isWide(m) {
+		return q.RGBA64ToPaletted(paletteColors, convertToRGBA64(m), buf)
+	}
 	rgbImg := convertToRGBA(m)
 	return q.RGBAToPaletted(paletteColors, rgbImg, buf)
 }
@@ -90,6 +165,8 @@ func (q *Quantizer) ToPaletted(paletteColors int, m image.Image, buf *Buffer) (*
 // If you wish to control allocations, pass an instance of wu2quant.Buffer to buf.
 // If you don't care, pass 'nil'.
 func (q *Quantizer) RGBAToPaletted(paletteColors int, m *image.RGBA, buf *Buffer) (*image.Paletted, error) {
+	paletteColors = q.paletteColors(paletteColors)
+
 	var (
 		cols   quantizedColors
 		size   = m.Bounds().Size()
@@ -102,35 +179,37 @@ func (q *Quantizer) RGBAToPaletted(paletteColors int, m *image.RGBA, buf *Buffer
 		return nil, err
 	}
 
-	var palette = make(color.Palette, cols.paletteSize)
-	for i := paletteIndex(0); i < cols.paletteSize; i++ {
-		palette[i] = color.RGBA{R: cols.rLut[i], G: cols.gLut[i], B: cols.bLut[i], A: 0xff}
-	}
-
-	var out = image.NewPaletted(image.Rect(0, 0, size.X, size.Y), palette)
-	var qaddIdx int
-	var qadd = buf.qadd
-	var vlen = len(out.Pix)
-
-	for i := 0; i < vlen; i++ {
-		out.Pix[i] = uint8(q.tag[qadd[qaddIdx]])
-		qaddIdx++
-	}
+	var palette = cols.appendTo(make(color.Palette, 0, paletteColors))
+	var out = image.NewPaletted(m.Bounds(), palette)
+	q.mapRGBA(out, m, &cols, buf.qadd, alphaMask(q.MapMask, m.Bounds()))
 
 	return out, nil
 }
 
 // IntoPaletted places a color-quantized copy of m into output image o. If m.Bounds() !=
-// o.Bounds(), an error is returned.
+// o.Bounds(), an error is returned. If paletteColors is 0, the Quantizer's Colors
+// is used.
+//
+// o may be a SubImage of a larger *image.Paletted; only the pixels within o's
+// bounds are written. o.Palette is replaced, and as a SubImage shares its
+// palette with the larger image, this overwrites the larger image's palette
+// entries if o.Palette has sufficient capacity.
 //
 // If m is not an *image.RGBA, it will be converted to one before quantization.
-// Depending on the image type, this may trigger very slow code paths.
+// Depending on the image type, this may trigger very slow code paths. Images
+// with 16 bits per channel are converted to an *image.RGBA64 instead, and are
+// quantized as described in QuantizeRGBA64.
 func (q *Quantizer) IntoPaletted(paletteColors int, m image.Image, o *image.Paletted, buf *Buffer) error {
+	if isWide(m) {
+		return q.RGBA64IntoPaletted(paletteColors, convertToRGBA64(m), o, buf)
+	}
 	rgbImg := convertToRGBA(m)
 	return q.RGBAIntoPaletted(paletteColors, rgbImg, o, buf)
 }
 
 func (q *Quantizer) RGBAIntoPaletted(paletteColors int, m *image.RGBA, o *image.Paletted, buf *Buffer) error {
+	paletteColors = q.paletteColors(paletteColors)
+
 	var (
 		cols   quantizedColors
 		bounds = m.Bounds()
@@ -148,70 +227,243 @@ func (q *Quantizer) RGBAIntoPaletted(paletteColors int, m *image.RGBA, o *image.
 		return err
 	}
 
-	if cap(o.Palette) < int(cols.paletteSize) {
-		o.Palette = make(color.Palette, cols.paletteSize)
-	} else {
-		o.Palette = o.Palette[:cols.paletteSize]
+	o.Palette = cols.appendTo(o.Palette[:0])
+	q.mapRGBA(o, m, &cols, buf.qadd, alphaMask(q.MapMask, bounds))
+
+	return nil
+}
+
+// mapRGBA writes the palette index of each pixel in m to the pixel with the same
+// coordinates in o, which may be a SubImage of a larger image. cols and qadd
+// must have been passed to the most recent call to quantize, and o.Palette must
+// contain the colours in cols. Pixels excluded by mask, which may be nil, are not
+// written.
+func (q *Quantizer) mapRGBA(o *image.Paletted, m *image.RGBA, cols *quantizedColors, qadd []paletteIndex, mask *image.Alpha) {
+	switch {
+	case cols.mapping == mapExact:
+		q.mapExact(o, m, mask)
+
+	case q.Dither:
+		q.dither(o, m)
+
+	case cols.mapping == mapLevels:
+		mapToLevels(o, m, cols.levels, mask)
+
+	case cols.mapping == mapPixels:
+		q.mapPixels(o, m, mask)
+
+	default:
+		q.mapParallel(o, m.Bounds(), qadd, mask)
 	}
-	for i := paletteIndex(0); i < cols.paletteSize; i++ {
-		o.Palette[i] = color.RGBA{R: cols.rLut[i], G: cols.gLut[i], B: cols.bLut[i], A: 0xff}
+
+	if cols.transparent {
+		mapTransparent(o, m, uint8(cols.paletteSize), mask)
 	}
+}
 
-	var qadd = buf.qadd
-	var qaddIdx int
-	var vlen = len(o.Pix)
+// mapParallel is mapQadd, split into the bands given by q.bands.
+func (q *Quantizer) mapParallel(o *image.Paletted, bounds image.Rectangle, qadd []paletteIndex, mask *image.Alpha) {
+	bands := q.bands(bounds)
+	if bands == nil {
+		q.mapQadd(o, bounds, qadd, mask)
+		return
+	}
 
-	for i := 0; i < vlen; i++ {
-		o.Pix[i] = uint8(q.tag[qadd[qaddIdx]])
-		qaddIdx++
+	var wg sync.WaitGroup
+	for _, band := range bands {
+		wg.Add(1)
+		go func(band image.Rectangle) {
+			defer wg.Done()
+			start := (band.Min.Y - bounds.Min.Y) * bounds.Dx()
+			q.mapQadd(o, band, qadd[start:], mask)
+		}(band)
 	}
+	wg.Wait()
+}
 
-	return nil
+// dither maps m to o.Palette with Floyd-Steinberg error diffusion.
+func (q *Quantizer) dither(o *image.Paletted, m *image.RGBA) {
+	if q.drawer == nil {
+		q.drawer = &Drawer{Op: draw.Src, Dither: true}
+	}
+	q.drawer.Weights = q.Weights
+	q.drawer.Draw(o, m.Bounds(), m, m.Bounds().Min)
+}
+
+// mapTransparent writes index to each pixel in o where the pixel with the same
+// coordinates in m has an alpha value below alphaThreshold. Pixels excluded by
+// mask, which may be nil, are not written.
+func mapTransparent(o *image.Paletted, m *image.RGBA, index uint8, mask *image.Alpha) {
+	bounds := m.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		pix := m.Pix[m.PixOffset(bounds.Min.X, y):][:bounds.Dx()*4]
+		row := o.Pix[o.PixOffset(bounds.Min.X, y):][:bounds.Dx()]
+		for x := range row {
+			if pix[x*4+3] < alphaThreshold && !maskedOut(mask, bounds.Min.X+x, y) {
+				row[x] = index
+			}
+		}
+	}
+}
+
+// mapQadd writes the palette index of each cell in qadd, as recorded by build for
+// an image with the given bounds, to the pixel with the same coordinates in o.
+// Pixels excluded by mask, which may be nil, are not written.
+func (q *Quantizer) mapQadd(o *image.Paletted, bounds image.Rectangle, qadd []paletteIndex, mask *image.Alpha) {
+	// Each row is written separately to skip o's stride gap:
+	width := bounds.Dx()
+	for y := 0; y < bounds.Dy(); y++ {
+		row := o.Pix[o.PixOffset(bounds.Min.X, bounds.Min.Y+y):][:width]
+		for x, cell := range qadd[y*width : (y+1)*width] {
+			if maskedOut(mask, bounds.Min.X+x, bounds.Min.Y+y) {
+				continue
+			}
+			row[x] = uint8(q.tag[cell])
+		}
+	}
+}
+
+// mapPixels is like mapRGBA, but looks up the cell of each pixel in m rather than
+// using the cells recorded by build.
+func (q *Quantizer) mapPixels(o *image.Paletted, m *image.RGBA, mask *image.Alpha) {
+	bounds := m.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		src := m.PixOffset(bounds.Min.X, y)
+		row := o.Pix[o.PixOffset(bounds.Min.X, y):][:bounds.Dx()]
+		for x := range row {
+			if !maskedOut(mask, bounds.Min.X+x, y) {
+				row[x] = uint8(q.tag[cellIndex(m.Pix[src], m.Pix[src+1], m.Pix[src+2])])
+			}
+			src += 4
+		}
+	}
+}
+
+// useExact reports whether Exact applies, given q's other settings.
+func (q *Quantizer) useExact() bool {
+	return q.Exact && q.Depth == (Depth{}) && q.PaletteMask == nil && q.Generator == GeneratorWu
 }
 
 func (q *Quantizer) reset() {
 	if q.dirty {
-		q.hist = histogram3D{}
-		for idx := range q.tag {
-			q.tag[idx] = 0
+		if q.hist.compacted {
+			extent := q.hist.extent()
+			q.hist.mark(&extent, 0, &q.tag)
+		} else if !q.hist.sparse {
+			for idx := range q.tag {
+				q.tag[idx] = 0
+			}
 		}
+		q.hist.clear()
 	}
+	q.hist.configure(q.Weights, q.ColorSpace == ColorSpaceLinear, q.Precise)
 	q.dirty = true
 }
 
+// validate checks the Quantizer's settings, and that paletteColors is within the
+// range supported by image.Paletted.
+func (q *Quantizer) validate(paletteColors int) error {
+	return q.validateUpTo(paletteColors, maxColors)
+}
+
+// validateUpTo is like validate, but allows palettes of up to limit colours.
+func (q *Quantizer) validateUpTo(paletteColors int, limit paletteIndex) error {
+	if err := checkPaletteColors(paletteColors, limit); err != nil {
+		return err
+	}
+	if q.Dither && paletteColors > int(maxColors) {
+		return fmt.Errorf("dithering supports palettes of up to %d colours; found %d", maxColors, paletteColors)
+	}
+	return q.Config.validate()
+}
+
 func (q *Quantizer) quantize(into *quantizedColors, img *image.RGBA, paletteColors int, qadd []paletteIndex) error {
-	if paletteColors <= 0 || paletteColors > int(maxColors) {
-		return fmt.Errorf("palette size must be 0 < sz < %d; found %d", maxColors, paletteColors)
+	return q.quantizeUpTo(into, img, paletteColors, maxColors, qadd)
+}
+
+// quantizeUpTo is like quantize, but allows palettes of up to limit colours.
+// Exact only applies to palettes of up to maxColors.
+func (q *Quantizer) quantizeUpTo(into *quantizedColors, img *image.RGBA, paletteColors int, limit paletteIndex, qadd []paletteIndex) error {
+	if err := q.validateUpTo(paletteColors, limit); err != nil {
+		return err
+	}
+
+	mask := alphaMask(q.PaletteMask, img.Bounds())
+	if q.Transparent && hasTransparency(img) {
+		// The last entry is reserved for the transparent pixels, which are left
+		// out of the histogram:
+		if paletteColors < 2 {
+			return fmt.Errorf("image contains transparency, palette size must be at least 2; found %d", paletteColors)
+		}
+		paletteColors--
+		into.transparent = true
+		mask = opaqueMask(img, mask)
+	}
+
+	if q.Generator != GeneratorWu {
+		return q.levelColors(into, paletteColors)
+	}
+
+	if !into.transparent && q.useExact() && paletteColors <= int(maxColors) && q.exactColors(into, img, paletteColors) {
+		return nil
 	}
 
 	q.reset()
+	switch {
+	case q.Sample.Mode != SampleAll:
+		q.hist.sample(img, q.Sample, mask)
+		into.mapping = mapPixels
+	case q.useSparse(img, mask):
+		q.hist.buildSparse(img, qadd)
+	case mask == nil && q.Parallelism > 1:
+		q.buildParallel(img, qadd)
+	default:
+		q.hist.buildMasked(img, mask, qadd)
+	}
+	q.palette(into, paletteColors)
+
+	return nil
+}
+
+func checkPaletteColors(paletteColors int, limit paletteIndex) error {
+	if paletteColors <= 0 || paletteColors > int(limit) {
+		return fmt.Errorf("palette size must be 0 < sz <= %d; found %d", limit, paletteColors)
+	}
+	return nil
+}
 
+// palette partitions the colour space described by the histogram into at most
+// paletteColors boxes, labels each cell in q.tag with the index of the box that
+// contains it, and stores the mean colour of each box in into. If q.Depth is
+// set, the colours and labels are then adjusted by snap, and otherwise if
+// q.Mapping is MapNearest the labels are adjusted by relabel.
+//
+// q.hist must contain a freshly built histogram; palette calculates the moments
+// in place so it can only be called once per build.
+func (q *Quantizer) palette(into *quantizedColors, paletteColors int) {
 	var (
 		paletteSize = paletteIndex(paletteColors)
-		cube        [maxColors]box
 		next        paletteIndex
-		vv          [maxColors]float32
 		temp        float32
 	)
 
-	q.hist.build(img, qadd)
-	q.hist.calculateMoments()
+	// The boxes are kept on the heap, as there may be up to maxWideColors:
+	if len(q.boxes) < paletteColors {
+		q.boxes = make([]box, paletteColors)
+		q.priorities = make([]float32, paletteColors)
+	}
+	cube, vv := q.boxes, q.priorities
 
-	cube[0].rmax, cube[0].gmax, cube[0].bmax = 32, 32, 32
+	if q.hist.sparse {
+		q.hist.compact()
+	}
+	cube[0] = q.hist.extent()
+	q.hist.calculateMoments(&cube[0])
 
 	for i := paletteIndex(1); i < paletteSize; i++ {
-		if cut(&cube[next], &cube[i], &q.hist.mr, &q.hist.mg, &q.hist.mb, &q.hist.wt) {
-			// volume test ensures we won't try to cut one-cell box
-			if cube[next].vol > 1 {
-				vv[next] = q.hist.weightedVariance(&cube[next])
-			} else {
-				vv[next] = 0
-			}
-			if cube[i].vol > 1 {
-				vv[i] = q.hist.weightedVariance(&cube[i])
-			} else {
-				vv[i] = 0
-			}
+		if q.cut(&cube[next], &cube[i]) {
+			vv[next] = q.priority(&cube[next])
+			vv[i] = q.priority(&cube[i])
 
 		} else {
 			vv[next] = 0.0 // don't try to split this box again
@@ -233,13 +485,13 @@ func (q *Quantizer) quantize(into *quantizedColors, img *image.RGBA, paletteColo
 	}
 
 	for k := paletteIndex(0); k < paletteSize; k++ {
-		mark(&cube[k], k, &q.tag)
+		q.hist.mark(&cube[k], k, &q.tag)
 
 		weight := vol(&cube[k], &q.hist.wt)
 		if weight != 0 {
-			into.rLut[k] = uint8(vol(&cube[k], &q.hist.mr) / weight)
-			into.gLut[k] = uint8(vol(&cube[k], &q.hist.mg) / weight)
-			into.bLut[k] = uint8(vol(&cube[k], &q.hist.mb) / weight)
+			into.rLut[k] = q.hist.decode(vol(&cube[k], &q.hist.mr) / weight)
+			into.gLut[k] = q.hist.decode(vol(&cube[k], &q.hist.mg) / weight)
+			into.bLut[k] = q.hist.decode(vol(&cube[k], &q.hist.mb) / weight)
 		} else {
 			// fprintf(stderr, "bogus box %d\n", k)
 			into.rLut[k], into.gLut[k], into.bLut[k] = 0, 0, 0
@@ -248,7 +500,40 @@ func (q *Quantizer) quantize(into *quantizedColors, img *image.RGBA, paletteColo
 
 	into.paletteSize = paletteSize
 
-	return nil
+	switch {
+	case q.Depth != (Depth{}):
+		q.snap(into)
+	case q.Mapping == MapNearest:
+		q.relabel(into)
+	}
+}
+
+// cut splits set1 in two according to q.Split, placing the upper half in set2.
+// It returns false if set1 can't be split.
+func (q *Quantizer) cut(set1, set2 *box) bool {
+	if q.Split == SplitMedian {
+		return medianCut(set1, set2, &q.hist.wt)
+	}
+	return cut(set1, set2, &q.hist.mr, &q.hist.mg, &q.hist.mb, &q.hist.wt, q.hist.weights)
+}
+
+// priority returns the value used to choose the next box to split; the box with
+// the largest priority is split first, and boxes with a priority of 0 are never
+// split.
+func (q *Quantizer) priority(cube *box) float32 {
+	// volume test ensures we won't try to cut one-cell box
+	if cube.vol <= 1 {
+		return 0
+	}
+
+	switch q.Split {
+	case SplitMedian, SplitPopulation:
+		return float32(vol(cube, &q.hist.wt))
+	case SplitVolume:
+		return float32(cube.vol)
+	default:
+		return q.hist.weightedVariance(cube)
+	}
 }
 
 type box struct {
@@ -260,20 +545,167 @@ type box struct {
 
 type paletteIndex uint16
 
-const maxColors paletteIndex = 256
+// maxColors is the largest palette supported by image.Paletted, and so by most of
+// the API. maxWideColors is the largest palette that can be written as uint16
+// indices by RGBAToIndices16.
+const (
+	maxColors     paletteIndex = 256
+	maxWideColors paletteIndex = 4096
+)
+
+// ChannelWeights scales the contribution of each channel to the distance between
+// two colours. The human eye is much more sensitive to green than to blue, so
+// weighting the channels accordingly can improve the perceived quality of the
+// palette.
+//
+// The zero value weights all channels equally.
+type ChannelWeights struct {
+	R, G, B float32
+}
+
+var (
+	// WeightsRec601 weights the channels by the Rec. 601 luma coefficients.
+	WeightsRec601 = ChannelWeights{R: 0.299, G: 0.587, B: 0.114}
+
+	// WeightsRec709 weights the channels by the Rec. 709 luma coefficients.
+	WeightsRec709 = ChannelWeights{R: 0.2126, G: 0.7152, B: 0.0722}
+
+	unitWeights = ChannelWeights{R: 1, G: 1, B: 1}
+)
+
+func (w ChannelWeights) orDefault() ChannelWeights {
+	if w == (ChannelWeights{}) {
+		return unitWeights
+	}
+	return w
+}
+
+// sampleTable contains, for every 8-bit value of each channel, the value that
+// is accumulated into the moments and its weighted square.
+type sampleTable struct {
+	value  [256]int64
+	sq     [3][256]float32
+	sq64   [3][256]float64
+	linear bool
+}
 
-var squares [256]int64
+var defaultSamples sampleTable
 
 func init() {
-	for i := int64(0); i < 256; i++ {
-		squares[i] = i * i
+	defaultSamples.init(unitWeights, false)
+}
+
+func (st *sampleTable) init(w ChannelWeights, linear bool) {
+	st.linear = linear
+	for i := range st.value {
+		v := int64(i)
+		if linear {
+			v = int64(srgbToLinear[i])
+		}
+		st.value[i] = v
+
+		sq := float32(v * v)
+		st.sq[0][i], st.sq[1][i], st.sq[2][i] = w.R*sq, w.G*sq, w.B*sq
+
+		sq64 := float64(v * v)
+		st.sq64[0][i], st.sq64[1][i], st.sq64[2][i] = float64(w.R)*sq64, float64(w.G)*sq64, float64(w.B)*sq64
 	}
 }
 
+// decode converts a mean of the values accumulated into the moments back to
+// an 8-bit channel value.
+func (st *sampleTable) decode(v int64) uint8 {
+	if st.linear {
+		return linearToSRGB(v)
+	}
+	return uint8(v)
+}
+
 type histogram3D struct {
 	mr, mg, mb moment
 	m2         momentFloat
 	wt         moment
+
+	// m2p replaces m2 if the histogram was configured to be precise. It is
+	// allocated separately so the larger array is only paid for when used.
+	m2p *momentFloat64
+
+	// wide is set if the moments were accumulated from 16-bit samples by build64.
+	wide bool
+
+	// sparse is set if the histogram was built by buildSparse, which records
+	// each occupied cell in cells. compact then moves the occupied cells so
+	// that the histogram only has the coordinates along each axis that are
+	// occupied, and records them in axes.
+	sparse    bool
+	compacted bool
+	cells     []paletteIndex
+	axes      [3][]int
+
+	// weights and samples are set by configure, and are not cleared along with
+	// the moments.
+	weights ChannelWeights
+	samples *sampleTable
+}
+
+func (hist *histogram3D) clear() {
+	switch {
+	case hist.compacted:
+		hist.clearBox(hist.extent())
+	case hist.sparse:
+		hist.clearCells()
+	default:
+		hist.mr, hist.mg, hist.mb = moment{}, moment{}, moment{}
+		hist.m2 = momentFloat{}
+		hist.wt = moment{}
+		if hist.m2p != nil {
+			*hist.m2p = momentFloat64{}
+		}
+	}
+	hist.wide = false
+	hist.sparse, hist.compacted = false, false
+	hist.cells = hist.cells[:0]
+}
+
+// configure sets the channel weights used to accumulate m2 and to measure the
+// variance of boxes, whether the moments are accumulated in linear light, and
+// whether m2 is accumulated in float64.
+func (hist *histogram3D) configure(w ChannelWeights, linear, precise bool) {
+	if !precise {
+		hist.m2p = nil
+	} else if hist.m2p == nil {
+		hist.m2p = new(momentFloat64)
+	}
+
+	w = w.orDefault()
+	if hist.samples != nil && w == hist.weights && linear == hist.samples.linear {
+		return
+	}
+
+	hist.weights = w
+	if w == unitWeights && !linear {
+		hist.samples = &defaultSamples
+	} else {
+		hist.samples = new(sampleTable)
+		hist.samples.init(w, linear)
+	}
+}
+
+func (hist *histogram3D) sampleTable() *sampleTable {
+	if hist.samples == nil {
+		return &defaultSamples
+	}
+	return hist.samples
+}
+
+// decode converts a mean of the values accumulated into the moments back to an
+// 8-bit channel value.
+func (hist *histogram3D) decode(v int64) uint8 {
+	st := hist.sampleTable()
+	if hist.wide && !st.linear {
+		return uint8((v + 0x80) / 0x101)
+	}
+	return st.decode(v)
 }
 
 // build 3-D color histogram of counts, r/g/b, c^2
@@ -295,21 +727,30 @@ func (hist *histogram3D) build(img *image.RGBA, qadd []paletteIndex) {
 	xmax := (bounds.Max.X - bounds.Min.X) * 4
 	xgap := img.Stride - xmax
 
-	max := len(pix)
-	if xgap > 0 {
-		// Subimages slice the pixel buffer to start at the first real pixel of
-		// the subimage:
-		//
-		//   . . . . . . . . . .    .  = image pixel
-		//   . .[x x x x x x(_ _    x  = subimage
-		//   _ _)x x x x x x(_ _    [] = subimage pix bounds
-		//   _ _)x x x x x x(_ _    _  = xgap pixel
-		//   _ _)x x x x x x!. .    () = xgap bounds
-		//   . . . . . . . . . .]   !  = where we want max
-		//
-		max = (img.Rect.Dx() * img.Rect.Dy() * 4) + (xgap * (img.Rect.Dy() - 1))
+	// Subimages slice the pixel buffer to start at the first real pixel of
+	// the subimage, but not to end at the last one:
+	//
+	//   . . . . . . . . . .    .  = image pixel
+	//   . .[x x x x x x(_ _    x  = subimage
+	//   _ _)x x x x x x(_ _    [] = subimage pix bounds
+	//   _ _)x x x x x x(_ _    _  = xgap pixel
+	//   _ _)x x x x x x!. .    () = xgap bounds
+	//   . . . . . . . . . .]   !  = where we want max
+	//
+	// This is also true of subimages with no xgap, such as a band of rows
+	// taken from the middle of an image.
+	max := 0
+	if dy := bounds.Dy(); dy > 0 && xmax > 0 {
+		max = (xmax * dy) + (xgap * (dy - 1))
 	}
 
+	var (
+		st  = hist.sampleTable()
+		val = &st.value
+		sq  = &st.sq
+		m2p = hist.m2p
+	)
+
 	x := 0
 	for idx := 0; idx < max; idx += 4 {
 		var (
@@ -324,10 +765,14 @@ func (hist *histogram3D) build(img *image.RGBA, qadd []paletteIndex) {
 		}
 
 		hist.wt[inr][ing][inb]++
-		hist.mr[inr][ing][inb] += r8
-		hist.mg[inr][ing][inb] += g8
-		hist.mb[inr][ing][inb] += b8
-		hist.m2[inr][ing][inb] += (float32)(squares[r8] + squares[g8] + squares[b8])
+		hist.mr[inr][ing][inb] += val[r8]
+		hist.mg[inr][ing][inb] += val[g8]
+		hist.mb[inr][ing][inb] += val[b8]
+		if m2p != nil {
+			m2p[inr][ing][inb] += st.sq64[0][r8] + st.sq64[1][g8] + st.sq64[2][b8]
+		} else {
+			hist.m2[inr][ing][inb] += sq[0][r8] + sq[1][g8] + sq[2][b8]
+		}
 
 		x += 4
 		if x == xmax {
@@ -337,23 +782,53 @@ func (hist *histogram3D) build(img *image.RGBA, qadd []paletteIndex) {
 	}
 }
 
+// add accumulates a single colour into the histogram and returns the index of
+// the cell it was counted in. It is the slow-path equivalent of one iteration
+// of build, for callers that need to choose which pixels are counted.
+func (hist *histogram3D) add(r8, g8, b8 int64) paletteIndex {
+	inr, ing, inb := (r8>>3)+1, (g8>>3)+1, (b8>>3)+1
+
+	st := hist.sampleTable()
+	hist.wt[inr][ing][inb]++
+	hist.mr[inr][ing][inb] += st.value[r8]
+	hist.mg[inr][ing][inb] += st.value[g8]
+	hist.mb[inr][ing][inb] += st.value[b8]
+	if hist.m2p != nil {
+		hist.m2p[inr][ing][inb] += st.sq64[0][r8] + st.sq64[1][g8] + st.sq64[2][b8]
+	} else {
+		hist.m2[inr][ing][inb] += st.sq[0][r8] + st.sq[1][g8] + st.sq[2][b8]
+	}
+
+	return paletteIndex((inr << 10) + (inr << 6) + inr + (ing << 5) + ing + inb)
+}
+
+// cellIndex returns the index into a tags table of the histogram cell
+// containing the colour r, g, b.
+func cellIndex(r, g, b uint8) paletteIndex {
+	inr, ing, inb := paletteIndex(r>>3)+1, paletteIndex(g>>3)+1, paletteIndex(b>>3)+1
+	return (inr << 10) + (inr << 6) + inr + (ing << 5) + ing + inb
+}
+
 // Convert histogram into moments so that we can rapidly calculate
 // the sums of the above quantities over any desired box.
 //
-func (hist *histogram3D) calculateMoments() {
-	for r := 1; r <= 32; r++ {
+// Only the cells inside cube are converted, which must contain every occupied
+// cell. Boxes inside cube may then be measured, as the cells below cube are
+// empty and so contribute nothing to the sums.
+func (hist *histogram3D) calculateMoments(cube *box) {
+	for r := cube.rmin + 1; r <= cube.rmax; r++ {
 		var (
 			area, rArea, gArea, bArea [33]int64
 			area2                     [33]float32
 		)
 
-		for g := 1; g <= 32; g++ {
+		for g := cube.gmin + 1; g <= cube.gmax; g++ {
 			var (
 				line, rLine, gLine, bLine int64
 				line2                     float32
 			)
 
-			for b := 1; b <= 32; b++ {
+			for b := cube.bmin + 1; b <= cube.bmax; b++ {
 				line += hist.wt[r][g][b]
 				rLine += hist.mr[r][g][b]
 				gLine += hist.mg[r][g][b]
@@ -375,11 +850,44 @@ func (hist *histogram3D) calculateMoments() {
 			}
 		}
 	}
+
+	if hist.m2p != nil {
+		hist.m2p.accumulate(cube)
+	}
+}
+
+// accumulate converts the cells of m inside cube into cumulative sums in the
+// same way calculateMoments does for the other moments.
+func (m *momentFloat64) accumulate(cube *box) {
+	for r := cube.rmin + 1; r <= cube.rmax; r++ {
+		var area [33]float64
+		for g := cube.gmin + 1; g <= cube.gmax; g++ {
+			var line float64
+			for b := cube.bmin + 1; b <= cube.bmax; b++ {
+				line += m[r][g][b]
+				area[b] += line
+				m[r][g][b] = m[r-1][g][b] + area[b]
+			}
+		}
+	}
+}
+
+// sumSquares returns the raw (not cumulative) sum of the weighted squares of
+// the colours in the cell r, g, b, from whichever of m2 or m2p is in use.
+func (hist *histogram3D) sumSquares(r, g, b int) float64 {
+	if hist.m2p != nil {
+		return hist.m2p[r][g][b]
+	}
+	return float64(hist.m2[r][g][b])
 }
 
 // Compute the weighted variance of a box
 // NB: as with the raw statistics, this is really the variance * size
 func (hist *histogram3D) weightedVariance(cube *box) float32 {
+	if hist.m2p != nil {
+		return hist.weightedVariance64(cube)
+	}
+
 	dr := float32(vol(cube, &hist.mr))
 	dg := float32(vol(cube, &hist.mg))
 	db := float32(vol(cube, &hist.mb))
@@ -393,7 +901,31 @@ func (hist *histogram3D) weightedVariance(cube *box) float32 {
 		hist.m2[cube.rmin][cube.gmin][cube.bmax] -
 		hist.m2[cube.rmin][cube.gmin][cube.bmin])
 
-	return xx - (((dr * dr) + (dg * dg) + (db * db)) / float32(vol(cube, &hist.wt)))
+	w := hist.weights
+	return xx - (((w.R * (dr * dr)) + (w.G * (dg * dg)) + (w.B * (db * db))) / float32(vol(cube, &hist.wt)))
+}
+
+// weightedVariance64 is weightedVariance using m2p, calculated in float64.
+func (hist *histogram3D) weightedVariance64(cube *box) float32 {
+	var (
+		m2 = hist.m2p
+		dr = float64(vol(cube, &hist.mr))
+		dg = float64(vol(cube, &hist.mg))
+		db = float64(vol(cube, &hist.mb))
+		xx = 0 +
+			m2[cube.rmax][cube.gmax][cube.bmax] -
+			m2[cube.rmax][cube.gmax][cube.bmin] -
+			m2[cube.rmax][cube.gmin][cube.bmax] +
+			m2[cube.rmax][cube.gmin][cube.bmin] -
+			m2[cube.rmin][cube.gmax][cube.bmax] +
+			m2[cube.rmin][cube.gmax][cube.bmin] +
+			m2[cube.rmin][cube.gmin][cube.bmax] -
+			m2[cube.rmin][cube.gmin][cube.bmin]
+	)
+
+	w := hist.weights
+	wr, wg, wb := float64(w.R), float64(w.G), float64(w.B)
+	return float32(xx - (((wr * (dr * dr)) + (wg * (dg * dg)) + (wb * (db * db))) / float64(vol(cube, &hist.wt))))
 }
 
 const (
@@ -405,9 +937,10 @@ const (
 )
 
 type (
-	momentDir   int
-	moment      [momentSize][momentSize][momentSize]int64
-	momentFloat [momentSize][momentSize][momentSize]float32
+	momentDir     int
+	moment        [momentSize][momentSize][momentSize]int64
+	momentFloat   [momentSize][momentSize][momentSize]float32
+	momentFloat64 [momentSize][momentSize][momentSize]float64
 )
 
 // Compute sum over a box of any given statistic
@@ -496,6 +1029,7 @@ func maximize(
 	cube *box, dir momentDir, first, last int,
 	rWhole, gWhole, bWhole, wWhole int64,
 	mr, mg, mb, wt *moment,
+	w ChannelWeights,
 ) (max float32, cut int) {
 
 	var (
@@ -520,9 +1054,9 @@ func maximize(
 			continue // never split into an empty box
 		} else {
 			temp = (0 +
-				(float32(rHalf) * float32(rHalf)) +
-				(float32(gHalf) * float32(gHalf)) +
-				(float32(bHalf) * float32(bHalf))) / float32(wHalf)
+				(w.R * (float32(rHalf) * float32(rHalf))) +
+				(w.G * (float32(gHalf) * float32(gHalf))) +
+				(w.B * (float32(bHalf) * float32(bHalf)))) / float32(wHalf)
 		}
 
 		rHalf = rWhole - rHalf
@@ -533,9 +1067,9 @@ func maximize(
 			continue // never split into an empty box
 		} else {
 			temp += (0 +
-				(float32(rHalf) * float32(rHalf)) +
-				(float32(gHalf) * float32(gHalf)) +
-				(float32(bHalf) * float32(bHalf))) / float32(wHalf)
+				(w.R * (float32(rHalf) * float32(rHalf))) +
+				(w.G * (float32(gHalf) * float32(gHalf))) +
+				(w.B * (float32(bHalf) * float32(bHalf)))) / float32(wHalf)
 		}
 
 		if temp > max {
@@ -550,6 +1084,7 @@ func maximize(
 func cut(
 	set1, set2 *box,
 	mr, mg, mb, wt *moment,
+	w ChannelWeights,
 ) bool {
 
 	rWhole := int64(vol(set1, mr))
@@ -557,9 +1092,9 @@ func cut(
 	bWhole := int64(vol(set1, mb))
 	wWhole := int64(vol(set1, wt))
 
-	maxr, cutr := maximize(set1, dirR, set1.rmin+1, set1.rmax, rWhole, gWhole, bWhole, wWhole, mr, mg, mb, wt)
-	maxg, cutg := maximize(set1, dirG, set1.gmin+1, set1.gmax, rWhole, gWhole, bWhole, wWhole, mr, mg, mb, wt)
-	maxb, cutb := maximize(set1, dirB, set1.bmin+1, set1.bmax, rWhole, gWhole, bWhole, wWhole, mr, mg, mb, wt)
+	maxr, cutr := maximize(set1, dirR, set1.rmin+1, set1.rmax, rWhole, gWhole, bWhole, wWhole, mr, mg, mb, wt, w)
+	maxg, cutg := maximize(set1, dirG, set1.gmin+1, set1.gmax, rWhole, gWhole, bWhole, wWhole, mr, mg, mb, wt, w)
+	maxb, cutb := maximize(set1, dirB, set1.bmin+1, set1.bmax, rWhole, gWhole, bWhole, wWhole, mr, mg, mb, wt, w)
 
 	var dir momentDir
 
@@ -576,32 +1111,114 @@ func cut(
 		}
 	}
 
+	var pos int
+	switch dir {
+	case dirR:
+		pos = cutr
+	case dirG:
+		pos = cutg
+	case dirB:
+		pos = cutb
+	}
+	split(set1, set2, dir, pos)
+	return true
+}
+
+// split divides set1 at pos along dir; set1 keeps the lower half and set2
+// receives the upper half.
+func split(set1, set2 *box, dir momentDir, pos int) {
 	set2.rmax = set1.rmax
 	set2.gmax = set1.gmax
 	set2.bmax = set1.bmax
 
 	switch dir {
 	case dirR:
-		set2.rmin = cutr
-		set1.rmax = cutr
+		set2.rmin = pos
+		set1.rmax = pos
 		set2.gmin = set1.gmin
 		set2.bmin = set1.bmin
 
 	case dirG:
-		set2.gmin = cutg
-		set1.gmax = cutg
+		set2.gmin = pos
+		set1.gmax = pos
 		set2.rmin = set1.rmin
 		set2.bmin = set1.bmin
 
 	case dirB:
-		set2.bmin = cutb
-		set1.bmax = cutb
+		set2.bmin = pos
+		set1.bmax = pos
 		set2.rmin = set1.rmin
 		set2.gmin = set1.gmin
 
 	}
 	set1.vol = (set1.rmax - set1.rmin) * (set1.gmax - set1.gmin) * (set1.bmax - set1.bmin)
 	set2.vol = (set2.rmax - set2.rmin) * (set2.gmax - set2.gmin) * (set2.bmax - set2.bmin)
+}
+
+// medianCut splits set1 at the population median along the axis on which the
+// cells containing pixels span the greatest distance, placing the upper half in
+// set2. It returns false if all of the pixels in set1 are in a single cell.
+func medianCut(set1, set2 *box, wt *moment) bool {
+	var (
+		whole   = vol(set1, wt)
+		bestDir momentDir
+		bestLen int
+		bestCut = -1
+	)
+
+	for _, dir := range [...]momentDir{dirR, dirG, dirB} {
+		var first, last int
+		switch dir {
+		case dirR:
+			first, last = set1.rmin, set1.rmax
+		case dirG:
+			first, last = set1.gmin, set1.gmax
+		case dirB:
+			first, last = set1.bmin, set1.bmax
+		}
+
+		var (
+			base     = bottom(set1, dir, wt)
+			lo, hi   = -1, last
+			median   = -1
+			distance int64
+		)
+
+		// lo is the first position with pixels below it, hi is the first position
+		// with every pixel below it. Any position in [lo, hi) splits the box into
+		// two non-empty halves.
+		for i := first + 1; i < last; i++ {
+			lower := base + top(set1, dir, i, wt)
+			if lower == 0 {
+				continue
+			}
+			if lower == whole {
+				hi = i
+				break
+			}
+			if lo < 0 {
+				lo = i
+			}
+
+			d := 2*lower - whole
+			if d < 0 {
+				d = -d
+			}
+			if median < 0 || d < distance {
+				median, distance = i, d
+			}
+		}
+
+		if median >= 0 && hi-lo > bestLen {
+			bestDir, bestLen, bestCut = dir, hi-lo, median
+		}
+	}
+
+	if bestCut < 0 {
+		return false
+	}
+
+	split(set1, set2, bestDir, bestCut)
 	return true
 }
 
@@ -617,12 +1234,57 @@ func mark(cube *box, label paletteIndex, tag *tags) {
 
 type quantizedColors struct {
 	// lut_r, lut_g, lut_b as color look-up table contents
-	rLut, gLut, bLut [maxColors]uint8
+	rLut, gLut, bLut [maxWideColors]uint8
 	paletteSize      paletteIndex
+
+	// mapping records how the pixels of the image must be mapped to the colours.
+	mapping mapping
+
+	// transparent is set if a fully transparent colour follows the quantized
+	// colours, for the pixels that were left out of the histogram by
+	// Config.Transparent.
+	transparent bool
+
+	// levels is the number of levels per channel if mapping is mapLevels.
+	levels Levels
+}
+
+type mapping int
+
+const (
+	// mapQadd uses the cells recorded in qadd by build.
+	mapQadd mapping = iota
+
+	// mapPixels finds the cell of each pixel, as build did not visit every pixel.
+	mapPixels
+
+	// mapExact finds the exact colour of each pixel in Quantizer.exact.
+	mapExact
+
+	// mapLevels finds the nearest level of each channel of each pixel, as the
+	// colours were produced by a PaletteGenerator other than GeneratorWu.
+	mapLevels
+)
+
+// appendTo appends the quantized colours to p as opaque color.RGBA values,
+// followed by the transparent colour if there is one.
+func (cols *quantizedColors) appendTo(p color.Palette) color.Palette {
+	for i := paletteIndex(0); i < cols.paletteSize; i++ {
+		p = append(p, color.RGBA{R: cols.rLut[i], G: cols.gLut[i], B: cols.bLut[i], A: 0xff})
+	}
+	if cols.transparent {
+		p = append(p, color.RGBA{})
+	}
+	return p
 }
 
 type Buffer struct {
 	qadd []paletteIndex
+
+	// out and narrow are used by RGBAToIndices and RGBAToIndices16 to map pixels
+	// into a caller's buffer without allocating.
+	out    image.Paletted
+	narrow []uint8
 }
 
 func BufferFromDims(x, y int) *Buffer {
@@ -3,6 +3,7 @@ package wu2quant
 import (
 	"image"
 	"image/color"
+	"image/draw"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -229,6 +230,55 @@ func TestIntoPaletted(t *testing.T) {
 	}
 }
 
+func TestToPalettedKeepsOrigin(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	img := genRGBAWithRandomRGBPerPixel(rng, 64, 64)
+	sub := img.SubImage(image.Rect(10, 20, 30, 50))
+
+	result, err := New().ToPaletted(8, sub, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Bounds() != sub.Bounds() {
+		t.Fatal(result.Bounds())
+	}
+}
+
+func TestIntoPalettedSubimage(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	img := genRGBAWithRandomRGBPerPixel(rng, 64, 64)
+	tileRect := image.Rect(16, 8, 48, 40)
+	tile := img.SubImage(tileRect)
+
+	exp, err := New().ToPaletted(8, tile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	canvas := image.NewPaletted(img.Bounds(), make(color.Palette, 0, 8))
+	for i := range canvas.Pix {
+		canvas.Pix[i] = 0xff
+	}
+
+	dest := canvas.SubImage(tileRect).(*image.Paletted)
+	if err := New().IntoPaletted(8, tile, dest, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			idx := canvas.ColorIndexAt(x, y)
+			if !(image.Point{x, y}).In(tileRect) {
+				if idx != 0xff {
+					t.Fatal("pixel outside tile modified", x, y)
+				}
+			} else if idx != exp.ColorIndexAt(x, y) {
+				t.Fatal("pixel inside tile incorrect", x, y)
+			}
+		}
+	}
+}
+
 func TestIntoPalettedWithBuffer(t *testing.T) {
 	rng := rand.New(rand.NewSource(0))
 	img1 := genRGBAWithRandomRGBPerPixel(rng, 100, 100)
@@ -266,6 +316,213 @@ func TestIntoPalettedWithBuffer(t *testing.T) {
 	}
 }
 
+func TestSplitStrategies(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	img := genRGBAWithRandomRGBPerPixel(rng, 128, 128)
+
+	exp, err := New().ToPaletted(16, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	palettes := map[SplitStrategy]color.Palette{}
+	for _, split := range []SplitStrategy{SplitVariance, SplitMedian, SplitPopulation, SplitVolume} {
+		q := New()
+		q.Split = split
+		result, err := q.ToPaletted(16, img, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Palette) != 16 {
+			t.Fatal(split, len(result.Palette))
+		}
+		palettes[split] = result.Palette
+	}
+
+	if !reflect.DeepEqual(exp.Palette, palettes[SplitVariance]) {
+		t.Fatal()
+	}
+	for _, split := range []SplitStrategy{SplitMedian, SplitPopulation, SplitVolume} {
+		if reflect.DeepEqual(palettes[SplitVariance], palettes[split]) {
+			t.Fatal(split)
+		}
+	}
+}
+
+func TestSplitMedian(t *testing.T) {
+	// A ramp of reds with 4 pixels in each of 25 cells; the median cut should
+	// land as close to half way as the cells allow:
+	img := image.NewRGBA(image.Rect(0, 0, 100, 1))
+	for x := 0; x < 100; x++ {
+		img.SetRGBA(x, 0, color.RGBA{uint8(x * 2), 0x40, 0x40, 0xff})
+	}
+
+	q := New()
+	q.Split = SplitMedian
+	result, err := q.ToPaletted(2, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var counts [2]int
+	for _, idx := range result.Pix {
+		counts[idx]++
+	}
+	if counts != [2]int{52, 48} && counts != [2]int{48, 52} {
+		t.Fatal(counts)
+	}
+}
+
+func TestChannelWeights(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	img.SetRGBA(0, 0, color.RGBA{0x00, 0x00, 0, 0xff})
+	img.SetRGBA(1, 0, color.RGBA{0xff, 0x00, 0, 0xff})
+	img.SetRGBA(0, 1, color.RGBA{0x00, 0xff, 0, 0xff})
+	img.SetRGBA(1, 1, color.RGBA{0xff, 0xff, 0, 0xff})
+
+	// With equal weights, the tie is broken by splitting red first:
+	out := New().Quantize(make(color.Palette, 0, 2), img)
+	exp := color.Palette{color.RGBA{0x00, 0x7f, 0, 0xff}, color.RGBA{0xff, 0x7f, 0, 0xff}}
+	if !reflect.DeepEqual(exp, out) {
+		t.Fatal(out)
+	}
+
+	// Green should win if it is weighted more heavily:
+	q := New()
+	q.Weights = WeightsRec709
+	out = q.Quantize(make(color.Palette, 0, 2), img)
+	exp = color.Palette{color.RGBA{0x7f, 0x00, 0, 0xff}, color.RGBA{0x7f, 0xff, 0, 0xff}}
+	if !reflect.DeepEqual(exp, out) {
+		t.Fatal(out)
+	}
+}
+
+func TestChannelWeightsInvalid(t *testing.T) {
+	q := New()
+	q.Weights = ChannelWeights{R: -1, G: 1, B: 1}
+	if _, err := q.ToPaletted(8, image.NewRGBA(image.Rect(0, 0, 1, 1)), nil); err == nil {
+		t.Fatal()
+	}
+}
+
+func TestLinear(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.SetRGBA(0, 0, color.RGBA{0x00, 0x00, 0x00, 0xff})
+	img.SetRGBA(1, 0, color.RGBA{0xff, 0xff, 0xff, 0xff})
+
+	// Averaging the sRGB values gives a grey that is too dark:
+	out := New().Quantize(make(color.Palette, 0, 1), img)
+	if out[0] != (color.RGBA{0x7f, 0x7f, 0x7f, 0xff}) {
+		t.Fatal(out)
+	}
+
+	// Half way between black and white in linear light:
+	q := New()
+	q.ColorSpace = ColorSpaceLinear
+	out = q.Quantize(make(color.Palette, 0, 1), img)
+	if out[0] != (color.RGBA{0xbc, 0xbc, 0xbc, 0xff}) {
+		t.Fatal(out)
+	}
+
+	// Colours that aren't averaged should survive the round trip:
+	out = q.Quantize(make(color.Palette, 0, 2), img)
+	if out[0] != (color.RGBA{0x00, 0x00, 0x00, 0xff}) || out[1] != (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Fatal(out)
+	}
+}
+
+func TestExact(t *testing.T) {
+	pal := genRandomRGBAPalette(rand.New(rand.NewSource(0)), 10)
+
+	// Make some colours close enough that Wu would merge them:
+	pal[1] = color.RGBA{pal[0].R + 1, pal[0].G, pal[0].B, 0xff}
+	img := genRings(pal, 20)
+
+	q := New()
+	q.Exact = true
+	result, err := q.ToPaletted(16, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Palette) != 10 {
+		t.Fatal(len(result.Palette))
+	}
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			if result.At(x, y) != img.At(x, y) {
+				t.Fatal(x, y)
+			}
+		}
+	}
+
+	// Too many colours should fall back to Wu:
+	exp, err := New().ToPaletted(8, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = q.ToPaletted(8, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exp, result) {
+		t.Fatal()
+	}
+}
+
+func TestExactIntoPaletted(t *testing.T) {
+	pal := genRandomRGBAPalette(rand.New(rand.NewSource(1)), 5)
+	img := genRings(pal, 10)
+
+	canvas := image.NewPaletted(image.Rect(0, 0, 20, 20), nil)
+	dest := canvas.SubImage(image.Rect(0, 0, 10, 10)).(*image.Paletted)
+
+	q := New()
+	q.Exact = true
+	if err := q.IntoPaletted(256, img, dest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(dest.Palette) != 5 {
+		t.Fatal(len(dest.Palette))
+	}
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			if dest.At(x, y) != img.At(x, y) {
+				t.Fatal(x, y)
+			}
+		}
+	}
+}
+
+func TestPrecise(t *testing.T) {
+	img := genRGBAWithRandomRGBPerPixel(rand.New(rand.NewSource(0)), 512, 512)
+
+	// Tile the image 4x4. Every sum in the histogram is multiplied by 16, which
+	// shouldn't change the palette as long as the sums are exact:
+	bounds := img.Bounds()
+	tiled := image.NewRGBA(image.Rect(0, 0, bounds.Dx()*4, bounds.Dy()*4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			draw.Draw(tiled, bounds.Add(image.Pt(x*bounds.Dx(), y*bounds.Dy())), img, image.Point{}, draw.Src)
+		}
+	}
+
+	q := New()
+	q.Precise = true
+	exp := q.Quantize(make(color.Palette, 0, 256), img)
+	result := q.Quantize(make(color.Palette, 0, 256), tiled)
+	if !reflect.DeepEqual(exp, result) {
+		t.Fatal()
+	}
+
+	// Switching back should give the same result as a new Quantizer:
+	q.Precise = false
+	exp = New().Quantize(make(color.Palette, 0, 256), img)
+	result = q.Quantize(make(color.Palette, 0, 256), img)
+	if !reflect.DeepEqual(exp, result) {
+		t.Fatal()
+	}
+}
+
 func BenchmarkToPaletted(b *testing.B) {
 	b.ReportAllocs()
 	img := genRGBAWithUniqueRGBPerPixel(512, 256)
@@ -315,6 +572,19 @@ func BenchmarkRGBAIntoPalettedBuffer(b *testing.B) {
 	}
 }
 
+func BenchmarkToPalettedIcon(b *testing.B) {
+	pal := genRandomRGBAPalette(rand.New(rand.NewSource(0)), 16)
+	img := genRings(pal, 32)
+	buf := NewBuffer(32 * 32)
+	q := New()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q.ToPaletted(16, img, buf)
+	}
+}
+
 func BenchmarkQuantize512x256(b *testing.B) {
 	b.ReportAllocs()
 	img := genRGBAWithUniqueRGBPerPixel(512, 256)